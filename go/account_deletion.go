@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 退会の流れ
+//
+// 退会を受け付けた時点で、ログインできなくし、これからの配信予約・フォロー・APIトークン・Webhook・
+// サブドメイン・リーダーボードから外す。
+// 通報対応などのために本人のデータは accountPurgeGracePeriod の間だけ残し、その後 purgeDeletedUser で消す。
+// 配信者の統計が変わらないように、ライブコメントとリアクションの行は残して本文とユーザ情報だけ匿名化する。
+// ユーザ情報は退会を受け付けた時点から fillUserResponse が匿名化して返す。
+
+// 退会を受け付けてから個人データを消すまでの猶予
+var accountPurgeGracePeriod int64 = 30 * 24 * 60 * 60
+
+// 匿名化したユーザの名前。nameはUNIQUEなのでIDを入れる。
+// 登録で使えないよう、registerHandler は deletedUserNamePrefix で始まる名前を断る
+const (
+	deletedUserNamePrefix = "deleted:"
+	deletedUserNameFormat = deletedUserNamePrefix + "%d"
+)
+
+// 退会したユーザの個人データを消しに行く間隔
+const accountPurgeScanInterval = 1 * time.Minute
+
+type DeleteAccountResponse struct {
+	DeletedAt int64 `json:"deleted_at"`
+	// この時刻を過ぎると個人データが消える
+	PurgeAt int64 `json:"purge_at"`
+}
+
+// 退会
+// DELETE /api/user/me
+func deleteMeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID)
+	if errors.Is(err, sql.ErrNoRows) || userModel.DeletedAt > 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	now := time.Now().Unix()
+
+	// これからの配信予約は取り消して枠を返す
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ? AND cancelled_at = 0 AND start_at > ? FOR UPDATE", userID, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	for _, livestreamModel := range livestreamModels {
+		if err := cancelLivestream(ctx, tx, livestreamModel); err != nil {
+			return err
+		}
+	}
+	// コラボ予定の配信からも抜ける
+	if _, err := tx.ExecContext(ctx, "DELETE lc FROM livestream_collaborators lc INNER JOIN livestreams l ON l.id = lc.livestream_id WHERE lc.user_id = ? AND l.start_at > ?", userID, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream collaborators: "+err.Error())
+	}
+
+	var followModels []*FollowModel
+	if err := tx.SelectContext(ctx, &followModels, "SELECT * FROM follows WHERE follower_id = ? OR followee_id = ? FOR UPDATE", userID, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get follows: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM follows WHERE follower_id = ? OR followee_id = ?", userID, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete follows: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE api_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at = 0", now, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke api tokens: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ?, last_error = ? WHERE webhook_id IN (SELECT id FROM webhooks WHERE user_id = ?) AND status = ?", webhookDeliveryFailed, "account deleted", userID, webhookDeliveryPending); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to cancel webhook deliveries: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhooks WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete webhooks: "+err.Error())
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET deleted_at = ? WHERE id = ?", now, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// DNSの更新は再送で数秒かかることがあるので、ロックを放してから行う。
+	// 退会は済んでいるので、消せなくてもエラーにせず purgeDeletedUser で消し直す
+	if err := deleteSubdomainRecord(context.WithoutCancel(ctx), userModel.Name); err != nil {
+		log.Printf("failed to delete subdomain record of deleted user %s: %+v", userModel.Name, err)
+	}
+
+	for _, followModel := range followModels {
+		if err := incrFollowCounts(ctx, followModel.FollowerID, followModel.FolloweeID, -1); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update follow counts: "+err.Error())
+		}
+	}
+	if err := redisClient.ZRem(ctx, UserLeaderBoardRedisKey, strconv.FormatInt(userID, 10)).Err(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to remove user from leader board: "+err.Error())
+	}
+	if err := revokeAllUserSessions(ctx, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke sessions: "+err.Error())
+	}
+
+	if err := clearSessionCookie(c); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to clear session: "+err.Error())
+	}
+
+	return c.JSON(http.StatusAccepted, DeleteAccountResponse{
+		DeletedAt: now,
+		PurgeAt:   now + accountPurgeGracePeriod,
+	})
+}
+
+func runAccountPurgeWorker(ctx context.Context) {
+	ticker := time.NewTicker(accountPurgeScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := purgeDeletedUsers(ctx); err != nil {
+				log.Printf("failed to purge deleted users: %+v", err)
+			}
+		}
+	}
+}
+
+// purgeDeletedUsers は猶予を過ぎた退会ユーザの個人データを消す。
+// 消せなかったユーザは次の周期でやり直すので、ログに出して残りのユーザを続ける
+func purgeDeletedUsers(ctx context.Context) error {
+	var userIDs []int64
+	if err := dbConn.SelectContext(ctx, &userIDs, "SELECT id FROM users WHERE deleted_at > 0 AND deleted_at <= ? AND purged_at = 0", time.Now().Unix()-accountPurgeGracePeriod); err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		if err := purgeDeletedUser(ctx, userID); err != nil {
+			log.Printf("failed to purge deleted user %d: %+v", userID, err)
+		}
+	}
+	return nil
+}
+
+func purgeDeletedUser(ctx context.Context, userID int64) error {
+	userModel := UserModel{}
+	if err := dbConn.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID); err != nil {
+		return err
+	}
+	if userModel.PurgedAt > 0 {
+		return nil
+	}
+	// 退会したときに消せなかったサブドメインを消しておく。
+	// 消せないうちは名前を解放しないよう、匿名化もしない
+	if err := deleteSubdomainRecord(ctx, userModel.Name); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		return err
+	}
+	if userModel.PurgedAt > 0 {
+		// 他のプロセスが先に消した
+		return nil
+	}
+
+	// アイコンのファイルは同じ画像を使っている他のユーザがいなければ消す
+	var iconModels []IconModel
+	if err := tx.SelectContext(ctx, &iconModels, "SELECT * FROM icons WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	iconHashes, err := deleteIcons(ctx, tx, iconModels)
+	if err != nil {
+		return err
+	}
+
+	if err := purgeUserData(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	// ユーザの行は配信・ライブコメント・リアクションから参照されるので残し、中身だけ消す
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET name = ?, display_name = '', description = '', password = '', icon_id = 0, purged_at = ? WHERE id = ?", fmt.Sprintf(deletedUserNameFormat, userID), time.Now().Unix(), userID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// コミットできなかったときにアイコンだけ消えないよう、ファイルはコミットしてから消す。
+	// 個人データの削除は済んでいるので、消せなかったファイルはログに出すだけにする
+	if err := removeUnusedIconFiles(ctx, userModel.Name, iconHashes); err != nil {
+		log.Printf("failed to remove icon files of purged user %d: %+v", userID, err)
+	}
+	return nil
+}
+
+// purgeUserData はユーザが書いたものと設定を消す
+// リアクションは絵文字しか持たないので、行は残してユーザの行の匿名化だけにする
+func purgeUserData(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	queries := []string{
+		// 配信者のチップやリアクションの集計が変わらないよう、行は残して本文だけ消す
+		"UPDATE livecomments SET comment = '' WHERE user_id = ?",
+		"DELETE FROM ng_words WHERE user_id = ?",
+		"DELETE FROM icons WHERE user_id = ?",
+		// themesはユーザの行を返すときに必ず引くので、消さずに初期値に戻す
+		"UPDATE themes SET dark_mode = FALSE WHERE user_id = ?",
+		"DELETE FROM notifications WHERE user_id = ?",
+		"DELETE FROM notification_settings WHERE user_id = ?",
+		"DELETE FROM api_tokens WHERE user_id = ?",
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// APIトークンのスコープ
+const (
+	apiTokenScopeRead             = "read"
+	apiTokenScopeLivecommentWrite = "livecomment:write"
+	apiTokenScopeLivestreamWrite  = "livestream:write"
+	apiTokenScopeModerate         = "moderate"
+	apiTokenScopeStatsRead        = "stats:read"
+)
+
+var apiTokenScopes = []string{
+	apiTokenScopeRead,
+	apiTokenScopeLivecommentWrite,
+	apiTokenScopeLivestreamWrite,
+	apiTokenScopeModerate,
+	apiTokenScopeStatsRead,
+}
+
+// APIトークンで叩けるエンドポイントと必要なスコープ。
+// ここに無いエンドポイント (ログインやトークン自体の管理、管理者向けなど) はCookieのセッションでしか叩けない
+var apiTokenRouteScopes = map[string]string{
+	"GET /api/tag":                                          apiTokenScopeRead,
+	"GET /api/user/:username/theme":                         apiTokenScopeRead,
+	"GET /api/livestream/search":                            apiTokenScopeRead,
+	"GET /api/livestream":                                   apiTokenScopeRead,
+	"GET /api/user/:username/livestream":                    apiTokenScopeRead,
+	"GET /api/feed":                                         apiTokenScopeRead,
+	"GET /api/notifications":                                apiTokenScopeRead,
+	"GET /api/livestream/series/:series_id":                 apiTokenScopeRead,
+	"GET /api/livestream/:livestream_id":                    apiTokenScopeRead,
+	"GET /api/livestream/:livestream_id/livecomment":        apiTokenScopeRead,
+	"GET /api/livestream/:livestream_id/reaction":           apiTokenScopeRead,
+	"GET /api/livestream/:livestream_id/livecomment/stream": apiTokenScopeRead,
+	"GET /api/user/me":                                      apiTokenScopeRead,
+	"GET /api/user/:username":                               apiTokenScopeRead,
+	"GET /api/user/:username/icon":                          apiTokenScopeRead,
+	"GET /api/icon/:hash":                                   apiTokenScopeRead,
+
+	"POST /api/livestream/:livestream_id/livecomment":                        apiTokenScopeLivecommentWrite,
+	"POST /api/livestream/:livestream_id/reaction":                           apiTokenScopeLivecommentWrite,
+	"POST /api/livestream/:livestream_id/livecomment/:livecomment_id/report": apiTokenScopeLivecommentWrite,
+	// WebSocketではリアクションを送れるので、受け取るだけでも書き込みのスコープがいる
+	"GET /api/livestream/:livestream_id/reaction/ws": apiTokenScopeLivecommentWrite,
+
+	"POST /api/livestream/reservation":                  apiTokenScopeLivestreamWrite,
+	"DELETE /api/livestream/:livestream_id/reservation": apiTokenScopeLivestreamWrite,
+	"PATCH /api/livestream/:livestream_id/reservation":  apiTokenScopeLivestreamWrite,
+	"DELETE /api/livestream/series/:series_id":          apiTokenScopeLivestreamWrite,
+	"PATCH /api/livestream/:livestream_id":              apiTokenScopeLivestreamWrite,
+
+	"GET /api/livestream/:livestream_id/report":    apiTokenScopeModerate,
+	"GET /api/livestream/:livestream_id/ngwords":   apiTokenScopeModerate,
+	"POST /api/livestream/:livestream_id/moderate": apiTokenScopeModerate,
+
+	"GET /api/user/:username/statistics":            apiTokenScopeStatsRead,
+	"GET /api/livestream/:livestream_id/statistics": apiTokenScopeStatsRead,
+}
+
+// 発行するトークンの先頭につける。漏洩検知で見つけやすくするため
+const apiTokenPrefix = "isu_"
+
+// 1ユーザが持てる有効なトークンの上限
+const maxAPITokensPerUser = 20
+
+// last_used_atはこの秒数より細かくは更新しない
+const apiTokenLastUsedResolution = 60
+
+// echo.Contextに認証に使ったトークンのIDを入れておくキー
+const apiTokenIDContextKey = "api_token_id"
+
+type APITokenModel struct {
+	ID     int64  `db:"id"`
+	UserID int64  `db:"user_id"`
+	Name   string `db:"name"`
+	// トークンそのものは保存せず、SHA-256のハッシュだけ持つ
+	TokenHash string `db:"token_hash"`
+	// カンマ区切り
+	Scopes     string `db:"scopes"`
+	CreatedAt  int64  `db:"created_at"`
+	ExpiresAt  int64  `db:"expires_at"`
+	LastUsedAt int64  `db:"last_used_at"`
+	RevokedAt  int64  `db:"revoked_at"`
+}
+
+type APIToken struct {
+	ID     int64    `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// 発行したときだけ返す
+	Token      string `json:"token,omitempty"`
+	CreatedAt  int64  `json:"created_at"`
+	ExpiresAt  int64  `json:"expires_at"`
+	LastUsedAt int64  `json:"last_used_at"`
+	RevokedAt  int64  `json:"revoked_at"`
+}
+
+type PostAPITokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// 有効期間の秒数。0なら無期限
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiTokenMiddleware は Authorization: Bearer のトークンを検証し、
+// Cookieでログインしたときと同じようにセッションへユーザを詰めてハンドラに渡す
+func apiTokenMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		authorization := c.Request().Header.Get(echo.HeaderAuthorization)
+		token, ok := strings.CutPrefix(authorization, "Bearer ")
+		if !ok {
+			return next(c)
+		}
+
+		ctx := c.Request().Context()
+		now := time.Now().Unix()
+
+		var tokenModel APITokenModel
+		err := dbConn.GetContext(ctx, &tokenModel, "SELECT * FROM api_tokens WHERE token_hash = ?", hashAPIToken(token))
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid api token")
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get api token: "+err.Error())
+		}
+		if tokenModel.RevokedAt > 0 {
+			return echo.NewHTTPError(http.StatusUnauthorized, "api token has been revoked")
+		}
+		if tokenModel.ExpiresAt > 0 && now > tokenModel.ExpiresAt {
+			return echo.NewHTTPError(http.StatusUnauthorized, "api token has expired")
+		}
+
+		scope, ok := apiTokenRouteScopes[c.Request().Method+" "+c.Path()]
+		if !ok {
+			return echo.NewHTTPError(http.StatusForbidden, "this endpoint does not accept api tokens")
+		}
+		if !slices.Contains(strings.Split(tokenModel.Scopes, ","), scope) {
+			return echo.NewHTTPError(http.StatusForbidden, "api token does not have the required scope: "+scope)
+		}
+
+		var username string
+		if err := dbConn.GetContext(ctx, &username, "SELECT name FROM users WHERE id = ?", tokenModel.UserID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+
+		if _, err := dbConn.ExecContext(ctx, "UPDATE api_tokens SET last_used_at = ? WHERE id = ? AND last_used_at <= ?", now, tokenModel.ID, now-apiTokenLastUsedResolution); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update api token: "+err.Error())
+		}
+
+		// session.Getはリクエスト内で同じセッションを返すので、ここで詰めた値がハンドラから見える。
+		// 保存はしないのでCookieは発行されない
+		sess, err := session.Get(defaultSessionIDKey, c)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get session: "+err.Error())
+		}
+		expiresAt := tokenModel.ExpiresAt
+		if expiresAt == 0 {
+			// 無期限のトークンでもこのリクエストの間は有効
+			expiresAt = now + int64(sessionLifetime/time.Second)
+		}
+		sess.Values = map[interface{}]interface{}{
+			defaultUserIDKey:         tokenModel.UserID,
+			defaultUsernameKey:       username,
+			defaultSessionExpiresKey: expiresAt,
+		}
+		c.Set(apiTokenIDContextKey, tokenModel.ID)
+
+		return next(c)
+	}
+}
+
+// APIトークンの発行
+// POST /api/user/me/tokens
+func postAPITokenHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	req := PostAPITokenRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Name == "" || len(req.Name) > 255 {
+		return echo.NewHTTPError(http.StatusBadRequest, "name must be 1 to 255 bytes")
+	}
+	if len(req.Scopes) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "scopes must not be empty")
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(apiTokenScopes, scope) {
+			return echo.NewHTTPError(http.StatusBadRequest, "unknown api token scope: "+scope)
+		}
+	}
+	if req.ExpiresIn < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "expires_in must not be negative")
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate api token: "+err.Error())
+	}
+	token := apiTokenPrefix + hex.EncodeToString(secret)
+
+	scopes := slices.Clone(req.Scopes)
+	slices.Sort(scopes)
+	scopes = slices.Compact(scopes)
+
+	now := time.Now().Unix()
+	tokenModel := APITokenModel{
+		UserID:    userID,
+		Name:      req.Name,
+		TokenHash: hashAPIToken(token),
+		Scopes:    strings.Join(scopes, ","),
+		CreatedAt: now,
+	}
+	if req.ExpiresIn > 0 {
+		tokenModel.ExpiresAt = now + req.ExpiresIn
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM api_tokens WHERE user_id = ? AND revoked_at = 0 AND (expires_at = 0 OR expires_at >= ?) FOR UPDATE", userID, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count api tokens: "+err.Error())
+	}
+	if count >= maxAPITokensPerUser {
+		return echo.NewHTTPError(http.StatusBadRequest, "a user can have at most "+strconv.Itoa(maxAPITokensPerUser)+" api tokens")
+	}
+
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at, expires_at) VALUES (:user_id, :name, :token_hash, :scopes, :created_at, :expires_at)", tokenModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert api token: "+err.Error())
+	}
+	tokenID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted api token id: "+err.Error())
+	}
+	tokenModel.ID = tokenID
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// トークンそのものを返すのはこの一度だけ
+	apiToken := apiTokenResponse(tokenModel)
+	apiToken.Token = token
+	return c.JSON(http.StatusCreated, apiToken)
+}
+
+// 発行したAPIトークンの一覧
+// GET /api/user/me/tokens
+func getAPITokensHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var tokenModels []APITokenModel
+	if err := dbConn.SelectContext(ctx, &tokenModels, "SELECT * FROM api_tokens WHERE user_id = ? ORDER BY id", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get api tokens: "+err.Error())
+	}
+
+	tokens := make([]APIToken, len(tokenModels))
+	for i := range tokenModels {
+		tokens[i] = apiTokenResponse(tokenModels[i])
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// APIトークンの失効
+// DELETE /api/user/me/tokens/:token_id
+func revokeAPITokenHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tokenID, err := strconv.ParseInt(c.Param("token_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "token_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at = 0", time.Now().Unix(), tokenID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke api token: "+err.Error())
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "api token not found")
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func apiTokenResponse(tokenModel APITokenModel) APIToken {
+	return APIToken{
+		ID:         tokenModel.ID,
+		Name:       tokenModel.Name,
+		Scopes:     strings.Split(tokenModel.Scopes, ","),
+		CreatedAt:  tokenModel.CreatedAt,
+		ExpiresAt:  tokenModel.ExpiresAt,
+		LastUsedAt: tokenModel.LastUsedAt,
+		RevokedAt:  tokenModel.RevokedAt,
+	}
+}
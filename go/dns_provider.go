@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// PowerDNSのHTTP APIを使うときの環境変数。URLが無ければpdnsutilを使う
+const (
+	powerDNSAPIURLEnvKey      = "ISUCON13_POWERDNS_API_URL"
+	powerDNSAPIKeyEnvKey      = "ISUCON13_POWERDNS_API_KEY"
+	powerDNSAPIServerIDEnvKey = "ISUCON13_POWERDNS_API_SERVER_ID"
+)
+
+// ユーザごとのサブドメインを置くゾーン
+const subdomainZone = "u.isucon.dev"
+
+// サブドメインのレコードのTTL
+const subdomainRecordTTL = 0
+
+// サブドメインの追加はこの件数・時間まで溜めてからまとめて送る
+const (
+	dnsBatchMaxSize = 100
+	dnsBatchWindow  = 10 * time.Millisecond
+)
+
+// 失敗したときの再送。待ち時間は dnsRetryBaseDelay から倍にしていく
+const (
+	dnsMaxAttempts    = 3
+	dnsRetryBaseDelay = 100 * time.Millisecond
+)
+
+// DNSProvider はユーザのサブドメインのAレコードを管理する
+type DNSProvider interface {
+	// AddRecords は names のサブドメインを powerDNSSubdomainAddress に向ける。すでにあれば置き換える
+	AddRecords(ctx context.Context, names []string) error
+	// DeleteRecords は存在しないレコードを消してもエラーにしない
+	DeleteRecords(ctx context.Context, names []string) error
+}
+
+var dnsProvider DNSProvider = &pdnsutilProvider{}
+
+// newDNSProviderFromEnv は ISUCON13_POWERDNS_API_URL があればHTTP APIを、無ければpdnsutilを使う
+func newDNSProviderFromEnv(apiURL, apiKey, serverID string) DNSProvider {
+	if apiURL == "" {
+		return &pdnsutilProvider{}
+	}
+	if serverID == "" {
+		serverID = "localhost"
+	}
+	return &powerDNSAPIProvider{
+		baseURL:  strings.TrimSuffix(apiURL, "/"),
+		apiKey:   apiKey,
+		serverID: serverID,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// pdnsutilProvider はPowerDNSと同じホストでpdnsutilを実行する
+type pdnsutilProvider struct{}
+
+func (p *pdnsutilProvider) AddRecords(ctx context.Context, names []string) error {
+	for _, name := range names {
+		if out, err := exec.CommandContext(ctx, "pdnsutil", "replace-rrset", subdomainZone, name, "A", fmt.Sprint(subdomainRecordTTL), powerDNSSubdomainAddress).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %w", out, err)
+		}
+	}
+	return nil
+}
+
+func (p *pdnsutilProvider) DeleteRecords(ctx context.Context, names []string) error {
+	for _, name := range names {
+		if out, err := exec.CommandContext(ctx, "pdnsutil", "delete-rrset", subdomainZone, name, "A").CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %w", out, err)
+		}
+	}
+	return nil
+}
+
+// powerDNSAPIProvider はPowerDNSのHTTP APIでゾーンを更新する。
+// 1回のPATCHで複数のレコードをまとめて変更できる
+type powerDNSAPIProvider struct {
+	baseURL  string
+	apiKey   string
+	serverID string
+	client   *http.Client
+}
+
+type powerDNSRRSet struct {
+	Name       string           `json:"name"`
+	Type       string           `json:"type"`
+	TTL        int64            `json:"ttl"`
+	ChangeType string           `json:"changetype"`
+	Records    []powerDNSRecord `json:"records,omitempty"`
+}
+
+type powerDNSRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+func (p *powerDNSAPIProvider) AddRecords(ctx context.Context, names []string) error {
+	rrsets := make([]powerDNSRRSet, len(names))
+	for i, name := range names {
+		rrsets[i] = powerDNSRRSet{
+			Name:       name + "." + subdomainZone + ".",
+			Type:       "A",
+			TTL:        subdomainRecordTTL,
+			ChangeType: "REPLACE",
+			Records:    []powerDNSRecord{{Content: powerDNSSubdomainAddress}},
+		}
+	}
+	return p.patchZone(ctx, rrsets)
+}
+
+func (p *powerDNSAPIProvider) DeleteRecords(ctx context.Context, names []string) error {
+	rrsets := make([]powerDNSRRSet, len(names))
+	for i, name := range names {
+		rrsets[i] = powerDNSRRSet{
+			Name:       name + "." + subdomainZone + ".",
+			Type:       "A",
+			ChangeType: "DELETE",
+		}
+	}
+	return p.patchZone(ctx, rrsets)
+}
+
+// patchZone は PATCH /api/v1/servers/:server_id/zones/:zone_id を送る
+func (p *powerDNSAPIProvider) patchZone(ctx context.Context, rrsets []powerDNSRRSet) error {
+	if len(rrsets) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(map[string][]powerDNSRRSet{"rrsets": rrsets})
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/api/v1/servers/%s/zones/%s.", p.baseURL, p.serverID, subdomainZone)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", p.apiKey)
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("powerdns responded %d: %s", res.StatusCode, msg)
+	}
+	return nil
+}
+
+// withDNSRetry は一時的な失敗を考えて、間隔を空けながら数回試す
+func withDNSRetry(ctx context.Context, f func() error) error {
+	var err error
+	delay := dnsRetryBaseDelay
+	for attempt := 1; attempt <= dnsMaxAttempts; attempt++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		if attempt == dnsMaxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	return err
+}
+
+type dnsAddRequest struct {
+	name   string
+	result chan error
+}
+
+// 同時に来たサブドメインの追加をまとめるためのキュー
+var dnsAddRequests = make(chan dnsAddRequest)
+
+// addSubdomainRecord はサブドメインを追加し、反映されるまで待つ。
+// 同時に来た登録とまとめて1回で送る。
+// キューに入れた後は呼び出し元が諦めても追加されるので、ctxがキャンセルされても結果を待つ。
+// nilを返したら、呼び出し元はこの後失敗したときに deleteSubdomainRecord で戻すこと
+func addSubdomainRecord(ctx context.Context, name string) error {
+	req := dnsAddRequest{name: name, result: make(chan error, 1)}
+	select {
+	case dnsAddRequests <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-req.result
+}
+
+// deleteSubdomainRecord はサブドメインを消す。消す頻度は低いのでまとめない
+func deleteSubdomainRecord(ctx context.Context, name string) error {
+	return withDNSRetry(ctx, func() error {
+		return dnsProvider.DeleteRecords(ctx, []string{name})
+	})
+}
+
+// runDNSRecordBatcher は dnsAddRequests を dnsBatchWindow の間溜めてから dnsProvider に送る
+func runDNSRecordBatcher(ctx context.Context) {
+	for {
+		var batch []dnsAddRequest
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-dnsAddRequests:
+			batch = append(batch, req)
+		}
+
+		timer := time.NewTimer(dnsBatchWindow)
+	collect:
+		for len(batch) < dnsBatchMaxSize {
+			select {
+			case req := <-dnsAddRequests:
+				batch = append(batch, req)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		names := make([]string, len(batch))
+		for i, req := range batch {
+			names[i] = req.name
+		}
+		err := withDNSRetry(ctx, func() error {
+			return dnsProvider.AddRecords(ctx, names)
+		})
+		if err == nil || len(batch) == 1 {
+			for _, req := range batch {
+				req.result <- err
+			}
+			continue
+		}
+
+		// 1件の不正な名前で全体が弾かれることがあるので、巻き添えにしないよう1件ずつ送り直す
+		log.Printf("failed to add %d subdomain records at once, retrying one by one: %+v", len(names), err)
+		for _, req := range batch {
+			req.result <- withDNSRetry(ctx, func() error {
+				return dnsProvider.AddRecords(ctx, []string{req.name})
+			})
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePowerDNS はPATCHされたrrsetsを記録するPowerDNSのHTTP APIの代わり
+type fakePowerDNS struct {
+	mu      sync.Mutex
+	patches [][]powerDNSRRSet
+	// trueを返したrrsetsを含むPATCHは422で断る
+	reject func(rrset powerDNSRRSet) bool
+	// nilでなければ、受け取ったことをreceivedに知らせてからholdが閉じられるまで応答しない
+	received chan struct{}
+	hold     chan struct{}
+}
+
+func (f *fakePowerDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "unexpected method "+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path != "/api/v1/servers/localhost/zones/u.isucon.dev." {
+		http.Error(w, "unexpected path "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("X-API-Key") != "secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		RRSets []powerDNSRRSet `json:"rrsets"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.hold != nil {
+		f.received <- struct{}{}
+		<-f.hold
+	}
+
+	f.mu.Lock()
+	f.patches = append(f.patches, body.RRSets)
+	f.mu.Unlock()
+
+	for _, rrset := range body.RRSets {
+		if f.reject != nil && f.reject(rrset) {
+			http.Error(w, "invalid rrset "+rrset.Name, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// acceptedNames は断らなかったPATCHで変更されたレコードの名前
+func (f *fakePowerDNS) acceptedNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var names []string
+	for _, rrsets := range f.patches {
+		accepted := true
+		for _, rrset := range rrsets {
+			if f.reject != nil && f.reject(rrset) {
+				accepted = false
+			}
+		}
+		if !accepted {
+			continue
+		}
+		for _, rrset := range rrsets {
+			names = append(names, rrset.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *fakePowerDNS) patchCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.patches)
+}
+
+// startFakePowerDNS はfakeを立てて dnsProvider をそこに向ける
+func startFakePowerDNS(t *testing.T, fake *fakePowerDNS) *powerDNSAPIProvider {
+	t.Helper()
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	provider := newDNSProviderFromEnv(server.URL+"/", "secret", "").(*powerDNSAPIProvider)
+
+	prevProvider, prevAddress := dnsProvider, powerDNSSubdomainAddress
+	dnsProvider, powerDNSSubdomainAddress = provider, "192.0.2.1"
+	t.Cleanup(func() {
+		dnsProvider, powerDNSSubdomainAddress = prevProvider, prevAddress
+	})
+	return provider
+}
+
+// startDNSRecordBatcher はテストの間だけ runDNSRecordBatcher を動かす
+func startDNSRecordBatcher(t *testing.T) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runDNSRecordBatcher(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestPowerDNSAPIProviderAddRecords(t *testing.T) {
+	fake := &fakePowerDNS{}
+	provider := startFakePowerDNS(t, fake)
+
+	if err := provider.AddRecords(context.Background(), []string{"alice", "bob"}); err != nil {
+		t.Fatalf("AddRecords: %v", err)
+	}
+
+	if len(fake.patches) != 1 {
+		t.Fatalf("got %d PATCH requests, want 1", len(fake.patches))
+	}
+	rrsets := fake.patches[0]
+	if len(rrsets) != 2 {
+		t.Fatalf("got %d rrsets, want 2", len(rrsets))
+	}
+	for i, name := range []string{"alice.u.isucon.dev.", "bob.u.isucon.dev."} {
+		rrset := rrsets[i]
+		if rrset.Name != name || rrset.Type != "A" || rrset.ChangeType != "REPLACE" || rrset.TTL != subdomainRecordTTL {
+			t.Errorf("rrsets[%d] = %+v", i, rrset)
+		}
+		if len(rrset.Records) != 1 || rrset.Records[0].Content != "192.0.2.1" || rrset.Records[0].Disabled {
+			t.Errorf("rrsets[%d].Records = %+v", i, rrset.Records)
+		}
+	}
+}
+
+func TestPowerDNSAPIProviderDeleteRecords(t *testing.T) {
+	fake := &fakePowerDNS{}
+	provider := startFakePowerDNS(t, fake)
+
+	if err := provider.DeleteRecords(context.Background(), []string{"alice"}); err != nil {
+		t.Fatalf("DeleteRecords: %v", err)
+	}
+
+	if len(fake.patches) != 1 || len(fake.patches[0]) != 1 {
+		t.Fatalf("got %+v, want 1 PATCH with 1 rrset", fake.patches)
+	}
+	rrset := fake.patches[0][0]
+	if rrset.Name != "alice.u.isucon.dev." || rrset.Type != "A" || rrset.ChangeType != "DELETE" || len(rrset.Records) != 0 {
+		t.Errorf("rrset = %+v", rrset)
+	}
+}
+
+func TestPowerDNSAPIProviderErrorStatus(t *testing.T) {
+	fake := &fakePowerDNS{
+		reject: func(powerDNSRRSet) bool { return true },
+	}
+	provider := startFakePowerDNS(t, fake)
+
+	err := provider.AddRecords(context.Background(), []string{"alice"})
+	if err == nil || !strings.Contains(err.Error(), "422") {
+		t.Fatalf("AddRecords: got %v, want an error with status 422", err)
+	}
+}
+
+func TestAddSubdomainRecordBatchesConcurrentRequests(t *testing.T) {
+	fake := &fakePowerDNS{}
+	startFakePowerDNS(t, fake)
+	startDNSRecordBatcher(t)
+
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = addSubdomainRecord(context.Background(), fmt.Sprintf("user%02d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("addSubdomainRecord(user%02d): %v", i, err)
+		}
+	}
+	names := fake.acceptedNames()
+	if len(names) != n {
+		t.Fatalf("got %d records, want %d: %v", len(names), n, names)
+	}
+	for i, name := range names {
+		if want := fmt.Sprintf("user%02d.u.isucon.dev.", i); name != want {
+			t.Errorf("names[%d] = %s, want %s", i, name, want)
+		}
+	}
+	if got := fake.patchCount(); got >= n {
+		t.Errorf("got %d PATCH requests for %d records, want them batched", got, n)
+	}
+}
+
+func TestAddSubdomainRecordIsolatesInvalidName(t *testing.T) {
+	fake := &fakePowerDNS{
+		reject: func(rrset powerDNSRRSet) bool { return rrset.Name == "bad.u.isucon.dev." },
+	}
+	startFakePowerDNS(t, fake)
+	startDNSRecordBatcher(t)
+
+	names := []string{"alice", "bad", "bob"}
+	var wg sync.WaitGroup
+	errs := make([]error, len(names))
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			errs[i] = addSubdomainRecord(context.Background(), name)
+		}(i, name)
+	}
+	wg.Wait()
+
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("valid names failed: alice=%v bob=%v", errs[0], errs[2])
+	}
+	if errs[1] == nil {
+		t.Error("invalid name succeeded")
+	}
+	got := fake.acceptedNames()
+	if want := []string{"alice.u.isucon.dev.", "bob.u.isucon.dev."}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got records %v, want %v", got, want)
+	}
+}
+
+func TestAddSubdomainRecordWaitsAfterCancel(t *testing.T) {
+	fake := &fakePowerDNS{received: make(chan struct{}, 1), hold: make(chan struct{})}
+	startFakePowerDNS(t, fake)
+	startDNSRecordBatcher(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- addSubdomainRecord(ctx, "alice")
+	}()
+
+	// PowerDNSに送られてからキャンセルし、その後に応答させる
+	<-fake.received
+	cancel()
+	close(fake.hold)
+
+	// 呼び出し元はレコードが追加されたことを知り、失敗したときに消せる
+	if err := <-result; err != nil {
+		t.Fatalf("addSubdomainRecord: got %v, want nil after the record was added", err)
+	}
+	if got := fake.acceptedNames(); len(got) != 1 || got[0] != "alice.u.isucon.dev." {
+		t.Errorf("got records %v, want [alice.u.isucon.dev.]", got)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+type FollowModel struct {
+	FollowerID int64 `db:"follower_id"`
+	FolloweeID int64 `db:"followee_id"`
+	CreatedAt  int64 `db:"created_at"`
+	// 配信予約・配信開始の通知を受け取るかどうか
+	Notify bool `db:"notify"`
+}
+
+// 配信者をフォローする
+// POST /api/user/:username/follow
+func followUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	followeeID, err := getUserIDByName(ctx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+	if followeeID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't follow yourself")
+	}
+
+	rs, err := dbConn.NamedExecContext(ctx, "INSERT IGNORE INTO follows (follower_id, followee_id, created_at) VALUES (:follower_id, :followee_id, :created_at)", FollowModel{
+		FollowerID: userID,
+		FolloweeID: followeeID,
+		CreatedAt:  time.Now().Unix(),
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert follow: "+err.Error())
+	}
+	inserted, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+
+	// すでにフォローしていたらカウンタは変えない
+	if inserted > 0 {
+		if err := incrFollowCounts(ctx, userID, followeeID, 1); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to incr follow counts: "+err.Error())
+		}
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// 配信者のフォローを外す
+// DELETE /api/user/:username/follow
+func unfollowUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	followeeID, err := getUserIDByName(ctx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", userID, followeeID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete follow: "+err.Error())
+	}
+	deleted, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+
+	if deleted > 0 {
+		if err := incrFollowCounts(ctx, userID, followeeID, -1); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to decr follow counts: "+err.Error())
+		}
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// フォローしている配信者の、これから始まる配信と配信中の配信を開始が近い順に返す
+// GET /api/feed
+func getFeedHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	page, err := parsePagination(c, 2)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil) // FIXME: selectのみのtxn
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModels []*LivestreamModel
+	query, params := page.ApplyAsc(
+		"SELECT l.* FROM follows f INNER JOIN livestreams l ON l.user_id = f.followee_id WHERE f.follower_id = ? AND l.cancelled_at = 0 AND l.end_at > ?",
+		[]interface{}{userID, time.Now().Unix()},
+		"l.start_at", "l.id",
+	)
+	if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	if page.Forward() {
+		slices.Reverse(livestreamModels)
+	}
+	var next pageCursor
+	if page.HasNext(len(livestreamModels)) {
+		last := livestreamModels[len(livestreamModels)-1]
+		if page.Forward() {
+			last = livestreamModels[0]
+		}
+		next = pageCursor{last.StartAt, last.ID}
+	}
+
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i := range livestreamModels {
+		// FIXME: N+1
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, newPageResponse(livestreams, next))
+}
+
+// getUserIDByName はユーザ名からユーザIDを引く。いなければecho.HTTPErrorを返す
+func getUserIDByName(ctx context.Context, username string) (int64, error) {
+	var userID int64
+	if err := dbConn.GetContext(ctx, &userID, "SELECT id FROM users WHERE name = ? AND deleted_at = 0", username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, echo.NewHTTPError(http.StatusNotFound, "user not found")
+		}
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	return userID, nil
+}
+
+// incrFollowCounts はフォロー数とフォロワー数のカウンタをdeltaだけ増やす
+func incrFollowCounts(ctx context.Context, followerID, followeeID int64, delta int64) error {
+	if err := redisClient.IncrBy(ctx, fmt.Sprintf("%s%d", followingCountCachePrefix, followerID), delta).Err(); err != nil {
+		return err
+	}
+	return redisClient.IncrBy(ctx, fmt.Sprintf("%s%d", followerCountCachePrefix, followeeID), delta).Err()
+}
+
+// getFollowCounts はフォロワー数とフォロー数を返す
+func getFollowCounts(ctx context.Context, userID int64) (followers int64, following int64, err error) {
+	values, err := redisClient.MGet(ctx,
+		fmt.Sprintf("%s%d", followerCountCachePrefix, userID),
+		fmt.Sprintf("%s%d", followingCountCachePrefix, userID),
+	).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	if v, ok := values[0].(string); ok {
+		followers, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := values[1].(string); ok {
+		following, _ = strconv.ParseInt(v, 10, 64)
+	}
+	return followers, following, nil
+}
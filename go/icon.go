@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// アップロードを受け付けるアイコンの上限
+const (
+	maxIconBytes     = 5 << 20
+	maxIconDimension = 4096
+	minIconDimension = 16
+)
+
+// アイコンはこの大きさの正方形に揃えて保存する
+var iconSizes = []int{64, 256, 512}
+
+// ?size= が無いときに返す大きさ。icons.hashはこの大きさの画像のハッシュ
+const defaultIconSize = 256
+
+// localIconStore の置き場所
+const iconDir = "/home/isucon/webapp/icons/"
+
+// アイコンが無いユーザに返す fallbackImage のハッシュ
+const fallbackIconHash = "d9f8294e9d895f81ce62e73dc7d5dff862a4fa40bd4e0fecf53f7526a8edcac0"
+
+// ハッシュで指定されたアイコンは中身が変わらないのでずっとキャッシュしてよい
+const immutableIconCacheControl = "public, max-age=31536000, immutable"
+
+// ユーザ名で指定されたアイコンは差し替わるので、キャッシュしてもETagで確認させる
+const mutableIconCacheControl = "public, max-age=0, must-revalidate"
+
+var errInvalidIcon = errors.New("invalid icon")
+
+// NormalizedIcon は大きさごとにエンコードし直したアイコン
+type NormalizedIcon struct {
+	ContentType string
+	Images      map[int][]byte
+}
+
+// iconKey は iconStore に置くときの名前。
+// 中身のハッシュで名前を付けるので、一度書いたものが別の画像で上書きされることはない
+func iconKey(hash string, size int) string {
+	return fmt.Sprintf("%s_%d", hash, size)
+}
+
+// iconETag は大きさごとに異なる強いETag
+func iconETag(hash string, size int) string {
+	return fmt.Sprintf(`"%s-%d"`, hash, size)
+}
+
+// iconETagMatches はIf-None-Matchのいずれかがetagと一致するかどうか
+func iconETagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveIcon はETagとCache-Controlを付けてアイコンを返す。
+// If-None-Matchが一致すれば中身を送らずに304を返す
+func serveIcon(c echo.Context, hash string, size int, contentType string, cacheControl string) error {
+	etag := iconETag(hash, size)
+	header := c.Response().Header()
+	header.Set(echo.HeaderCacheControl, cacheControl)
+	header.Set("ETag", etag)
+
+	if iconETagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	if hash == fallbackIconHash {
+		return c.File(fallbackImage)
+	}
+	image, err := iconStore.Get(c.Request().Context(), iconKey(hash, size))
+	if errors.Is(err, errIconNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "icon is missing in the icon store")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon: "+err.Error())
+	}
+	// 保存したときの形式をそのまま返す
+	return c.Blob(http.StatusOK, contentType, image)
+}
+
+// getUserIcon はユーザの今のアイコンを返す。アイコンが無ければnil
+func getUserIcon(ctx context.Context, q sqlx.QueryerContext, userModel UserModel) (*IconModel, error) {
+	var iconModel IconModel
+	var err error
+	if userModel.IconID > 0 {
+		err = sqlx.GetContext(ctx, q, &iconModel, "SELECT * FROM icons WHERE id = ? AND user_id = ?", userModel.IconID, userModel.ID)
+	} else {
+		// 履歴から選び直す前にアップロードされたもの
+		err = sqlx.GetContext(ctx, q, &iconModel, "SELECT * FROM icons WHERE user_id = ? ORDER BY id DESC LIMIT 1", userModel.ID)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		// 初期データのアイコンはまだ取り込んでいないかもしれない
+		return importLegacyIconOnce(ctx, userModel)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &iconModel, nil
+}
+
+// 初期データのアイコンを取り込んだかどうか。initializeでFlushAllされる。userIDをappendして使うこと
+const legacyIconImportedCachePrefix = "legacy_icon_imported:user:"
+
+// importLegacyIconOnce は初期データのアイコンを、そのユーザのアイコンが最初に引かれたときに取り込む。
+// 大きさを揃えるのが重いので initialize ではまとめて行わない。
+// 取り込みが済んだら印を付け、後で履歴をすべて消したユーザに初期データのアイコンが戻らないようにする。
+// 取り込めなかったときはログに出してアイコン無しとして返し、次に引かれたときにやり直す
+func importLegacyIconOnce(ctx context.Context, userModel UserModel) (*IconModel, error) {
+	key := fmt.Sprintf("%s%d", legacyIconImportedCachePrefix, userModel.ID)
+	imported, err := redisClient.Exists(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if imported > 0 {
+		return nil, nil
+	}
+
+	iconModel, err := importLegacyIcon(ctx, userModel)
+	if err != nil {
+		log.Printf("failed to import the icon of user %s: %+v", userModel.Name, err)
+		return nil, nil
+	}
+	if err := redisClient.Set(ctx, key, 1, 0).Err(); err != nil {
+		return nil, err
+	}
+	return iconModel, nil
+}
+
+// importLegacyIcon は初期データのアイコンを大きさを揃えて iconStore に置き、icons に登録する。
+// 初期データのアイコンは init.sh でローカルの iconDir にユーザ名のファイル名で置かれる。
+// ファイルが無いか画像として読めなければnilを返す。並行して呼ばれても同じ行になるので何度呼んでもよい
+func importLegacyIcon(ctx context.Context, userModel UserModel) (*IconModel, error) {
+	legacy, err := os.ReadFile(iconDir + userModel.Name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	icon, err := normalizeIcon(legacy)
+	if errors.Is(err, errInvalidIcon) {
+		// 画像として読めないものはアイコン無しと同じ扱い
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := saveIconFiles(ctx, icon); err != nil {
+		return nil, err
+	}
+
+	_, err = dbConn.NamedExecContext(ctx, "INSERT IGNORE INTO icons (user_id, hash, content_type, created_at) VALUES (:user_id, :hash, :content_type, :created_at)", IconModel{
+		UserID:      userModel.ID,
+		Hash:        icon.Hash(),
+		ContentType: icon.ContentType,
+		CreatedAt:   time.Now().Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 呼び出し元のトランザクションからは見えないことがあるので、dbConnで読み直す
+	var iconModel IconModel
+	if err := dbConn.GetContext(ctx, &iconModel, "SELECT * FROM icons WHERE user_id = ? AND hash = ?", userModel.ID, icon.Hash()); err != nil {
+		return nil, err
+	}
+	return &iconModel, nil
+}
+
+// parseIconSize は ?size= を読む。無ければ defaultIconSize
+func parseIconSize(c echo.Context) (int, error) {
+	v := c.QueryParam("size")
+	if v == "" {
+		return defaultIconSize, nil
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || !slices.Contains(iconSizes, size) {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "size in query must be one of 64, 256 or 512")
+	}
+	return size, nil
+}
+
+// normalizeIcon はアップロードされた画像を検証し、正方形に切り抜いて iconSizes の大きさに縮小する。
+// JPEGはJPEGのまま、透過のありうるPNG・GIF・WebPはPNGにする。アニメーションGIFは1枚目だけ使う
+func normalizeIcon(data []byte) (*NormalizedIcon, error) {
+	if len(data) == 0 || len(data) > maxIconBytes {
+		return nil, fmt.Errorf("%w: image must be 1 to %d bytes", errInvalidIcon, maxIconBytes)
+	}
+
+	// 巨大な画像を展開しないよう、先にヘッダだけ読んで大きさを確かめる
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: image must be jpeg, png, gif or webp", errInvalidIcon)
+	}
+	if config.Width < minIconDimension || config.Height < minIconDimension ||
+		config.Width > maxIconDimension || config.Height > maxIconDimension {
+		return nil, fmt.Errorf("%w: image must be %d to %d pixels on each side", errInvalidIcon, minIconDimension, maxIconDimension)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode %s image", errInvalidIcon, format)
+	}
+
+	// 中央を正方形に切り抜く
+	bounds := src.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	crop := image.Rect(0, 0, side, side).Add(bounds.Min).Add(image.Pt((bounds.Dx()-side)/2, (bounds.Dy()-side)/2))
+
+	icon := &NormalizedIcon{
+		ContentType: "image/png",
+		Images:      make(map[int][]byte, len(iconSizes)),
+	}
+	if format == "jpeg" {
+		icon.ContentType = "image/jpeg"
+	}
+
+	for _, size := range iconSizes {
+		dst := image.NewRGBA(image.Rect(0, 0, size, size))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+
+		var buf bytes.Buffer
+		if icon.ContentType == "image/jpeg" {
+			err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 90})
+		} else {
+			err = png.Encode(&buf, dst)
+		}
+		if err != nil {
+			return nil, err
+		}
+		icon.Images[size] = buf.Bytes()
+	}
+
+	return icon, nil
+}
+
+// Hash は ?size= を付けずに取得したときの画像のハッシュ。icons.hashに入れる
+func (icon *NormalizedIcon) Hash() string {
+	return fmt.Sprintf("%x", sha256.Sum256(icon.Images[defaultIconSize]))
+}
+
+// saveIconFiles はアイコンを大きさごとに iconStore に置く
+func saveIconFiles(ctx context.Context, icon *NormalizedIcon) error {
+	hash := icon.Hash()
+	for size, image := range icon.Images {
+		if err := iconStore.Put(ctx, iconKey(hash, size), image, icon.ContentType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeIconFiles はアイコンを iconStore から消す。
+// 同じ画像を使っている他のユーザがいるハッシュは渡さないこと
+func removeIconFiles(ctx context.Context, username string, hashes []string) error {
+	var keys []string
+	// 初期データのアイコンはユーザ名で置いてある
+	if username != "" {
+		keys = append(keys, username)
+	}
+	for _, hash := range hashes {
+		for _, size := range iconSizes {
+			keys = append(keys, iconKey(hash, size))
+		}
+	}
+	for _, key := range keys {
+		if err := iconStore.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 1ユーザが残しておけるアイコンの数。超えたら古いものから消す
+const maxIconHistory = 20
+
+type Icon struct {
+	ID          int64  `json:"id"`
+	Hash        string `json:"hash"`
+	ContentType string `json:"content_type"`
+	CreatedAt   int64  `json:"created_at"`
+	// 今のアイコンかどうか
+	Current bool `json:"current"`
+}
+
+// アップロードしたアイコンの履歴
+// GET /api/user/me/icons
+func getIconHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	current, err := getUserIcon(ctx, tx, userModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error())
+	}
+
+	var iconModels []IconModel
+	if err := tx.SelectContext(ctx, &iconModels, "SELECT * FROM icons WHERE user_id = ? ORDER BY id DESC", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icons: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	icons := make([]Icon, len(iconModels))
+	for i, iconModel := range iconModels {
+		icons[i] = Icon{
+			ID:          iconModel.ID,
+			Hash:        iconModel.Hash,
+			ContentType: iconModel.ContentType,
+			CreatedAt:   iconModel.CreatedAt,
+			Current:     current != nil && current.ID == iconModel.ID,
+		}
+	}
+	return c.JSON(http.StatusOK, icons)
+}
+
+// 以前のアイコンに戻す
+// POST /api/user/me/icons/:icon_id/select
+func selectIconHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	iconID, err := strconv.ParseInt(c.Param("icon_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "icon_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	if _, err := getOwnedIcon(ctx, tx, iconID, userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET icon_id = ? WHERE id = ?", iconID, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to select icon: "+err.Error())
+	}
+	userModel.IconID = iconID
+
+	user, err := fillUserResponse(ctx, tx, userModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// 履歴からアイコンを消す。今のアイコンを消したら残っている中で一番新しいものに戻る
+// DELETE /api/user/me/icons/:icon_id
+func deleteIconHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	iconID, err := strconv.ParseInt(c.Param("icon_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "icon_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	iconModel, err := getOwnedIcon(ctx, tx, iconID, userID)
+	if err != nil {
+		return err
+	}
+
+	orphanHashes, err := deleteIcons(ctx, tx, []IconModel{*iconModel})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete icon: "+err.Error())
+	}
+
+	if userModel.IconID == iconID {
+		// 残っている中で一番新しいものを選ぶ。何も残っていなければ0になりアイコン無しになる
+		var nextIconID int64
+		if err := tx.GetContext(ctx, &nextIconID, "SELECT COALESCE(MAX(id), 0) FROM icons WHERE user_id = ?", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET icon_id = ? WHERE id = ?", nextIconID, userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to select icon: "+err.Error())
+		}
+	}
+
+	// 初期データのアイコンは最初に引かれたときに履歴に入っているので、
+	// 元のファイルも消して、消したアイコンが再び取り込まれないようにする
+	if err := removeIconFiles(ctx, userModel.Name, orphanHashes); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to remove icon: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func getOwnedIcon(ctx context.Context, tx *sqlx.Tx, iconID, userID int64) (*IconModel, error) {
+	var iconModel IconModel
+	err := tx.GetContext(ctx, &iconModel, "SELECT * FROM icons WHERE id = ? AND user_id = ?", iconID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "icon not found")
+	}
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon: "+err.Error())
+	}
+	return &iconModel, nil
+}
+
+// trimIconHistory は maxIconHistory を超えた古いアイコンを消し、どこからも使われなくなったハッシュを返す。
+// keepIconIDは古くても消さない
+func trimIconHistory(ctx context.Context, tx *sqlx.Tx, userID, keepIconID int64) ([]string, error) {
+	var iconModels []IconModel
+	if err := tx.SelectContext(ctx, &iconModels, "SELECT * FROM icons WHERE user_id = ? AND id != ? ORDER BY id DESC LIMIT 18446744073709551615 OFFSET ?", userID, keepIconID, maxIconHistory-1); err != nil {
+		return nil, err
+	}
+	return deleteIcons(ctx, tx, iconModels)
+}
+
+// deleteIcons はアイコンの行を消し、他のユーザも含めてどこからも使われなくなったハッシュを返す。
+// 同じ画像のアップロードと競合しないよう、ハッシュをロックして確かめる。
+// 返したハッシュの画像はロックを持っているうち (コミットする前) に removeIconFiles で消すこと。
+// コミットした後に消すときは removeUnusedIconFiles で確かめ直すこと。
+// そのまま消すと、その間に同じ画像をアップロードしたユーザの画像まで消してしまう
+func deleteIcons(ctx context.Context, tx *sqlx.Tx, iconModels []IconModel) ([]string, error) {
+	if len(iconModels) == 0 {
+		return nil, nil
+	}
+
+	iconIDs := make([]int64, len(iconModels))
+	hashes := make([]string, len(iconModels))
+	for i, iconModel := range iconModels {
+		iconIDs[i] = iconModel.ID
+		hashes[i] = iconModel.Hash
+	}
+
+	query, args, err := sqlx.In("DELETE FROM icons WHERE id IN (?)", iconIDs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+
+	return lockUnusedIconHashes(ctx, tx, hashes)
+}
+
+// lockUnusedIconHashes はハッシュをロックし、どの行からも使われていないものを重複なく返す。
+// 同じハッシュの行を追加しようとしている postIconHandler がいれば、そのコミットを待つ
+func lockUnusedIconHashes(ctx context.Context, tx *sqlx.Tx, hashes []string) ([]string, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In("SELECT DISTINCT hash FROM icons WHERE hash IN (?) FOR UPDATE", hashes)
+	if err != nil {
+		return nil, err
+	}
+	var usedHashes []string
+	if err := tx.SelectContext(ctx, &usedHashes, tx.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool, len(usedHashes))
+	for _, hash := range usedHashes {
+		used[hash] = true
+	}
+
+	var orphanHashes []string
+	for _, hash := range hashes {
+		if !used[hash] {
+			used[hash] = true
+			orphanHashes = append(orphanHashes, hash)
+		}
+	}
+	return orphanHashes, nil
+}
+
+// removeUnusedIconFiles は deleteIcons が返したハッシュの画像を、コミットした後に消す。
+// コミットしてからの間に同じ画像がアップロードされていることがあるので、ロックし直してまだ使われていないものだけ消す
+func removeUnusedIconFiles(ctx context.Context, username string, hashes []string) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	orphanHashes, err := lockUnusedIconHashes(ctx, tx, hashes)
+	if err != nil {
+		return err
+	}
+	if err := removeIconFiles(ctx, username, orphanHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
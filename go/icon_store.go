@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// アイコンの保存先を選ぶ環境変数
+const (
+	iconStoreEnvKey             = "ISUCON13_ICON_STORE"
+	iconS3EndpointEnvKey        = "ISUCON13_ICON_S3_ENDPOINT"
+	iconS3BucketEnvKey          = "ISUCON13_ICON_S3_BUCKET"
+	iconS3RegionEnvKey          = "ISUCON13_ICON_S3_REGION"
+	iconS3AccessKeyIDEnvKey     = "ISUCON13_ICON_S3_ACCESS_KEY_ID"
+	iconS3SecretAccessKeyEnvKey = "ISUCON13_ICON_S3_SECRET_ACCESS_KEY"
+)
+
+var errIconNotFound = errors.New("icon not found")
+
+// IconStore はアイコンの画像を置いておく場所。
+// 複数台で動かすときはすべてのサーバから同じものが見えるS3互換のストレージを使うこと
+type IconStore interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// 存在しないキーを消してもエラーにしない
+	Delete(ctx context.Context, key string) error
+}
+
+// 標準ではローカルのディレクトリに置く
+var iconStore IconStore = &localIconStore{dir: iconDir}
+
+// newIconStoreFromEnv は ISUCON13_ICON_STORE で選ばれた保存先を作る
+func newIconStoreFromEnv(kind string) (IconStore, error) {
+	switch kind {
+	case "local":
+		return &localIconStore{dir: iconDir}, nil
+	case "s3":
+		endpoint, err := url.Parse(os.Getenv(iconS3EndpointEnvKey))
+		if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			return nil, fmt.Errorf("%s must be an absolute url", iconS3EndpointEnvKey)
+		}
+		store := &s3IconStore{
+			endpoint:        endpoint,
+			bucket:          os.Getenv(iconS3BucketEnvKey),
+			region:          os.Getenv(iconS3RegionEnvKey),
+			accessKeyID:     os.Getenv(iconS3AccessKeyIDEnvKey),
+			secretAccessKey: os.Getenv(iconS3SecretAccessKeyEnvKey),
+			client:          &http.Client{Timeout: 10 * time.Second},
+		}
+		if store.bucket == "" {
+			return nil, fmt.Errorf("%s must not be empty", iconS3BucketEnvKey)
+		}
+		if store.region == "" {
+			store.region = "us-east-1"
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown icon store: %s", kind)
+	}
+}
+
+// localIconStore はサーバのディレクトリにファイルとして置く
+type localIconStore struct {
+	dir string
+}
+
+func (s *localIconStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.Base(key))
+}
+
+func (s *localIconStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errIconNotFound
+	}
+	return data, err
+}
+
+// Put は読み込み中のリクエストに書きかけのファイルを見せないよう、一時ファイルからrenameする。
+// 同じキーを並行して書いても混ざらないよう、一時ファイルは書き込みごとに別の名前にする
+func (s *localIconStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	path := s.path(key)
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".icon-*")
+	if err != nil {
+		return err
+	}
+	// renameした後は消えているので、エラーは無視してよい
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// CreateTempは0600で作るので、WriteFileで作っていたときと同じ権限にする
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localIconStore) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// s3IconStore はS3互換のオブジェクトストレージに置く。
+// MinIOなどでも使えるよう、バケットはパス形式 (endpoint/bucket/key) で指定する
+type s3IconStore struct {
+	endpoint        *url.URL
+	bucket          string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	client          *http.Client
+}
+
+func (s *s3IconStore) Get(ctx context.Context, key string) ([]byte, error) {
+	res, err := s.do(ctx, http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(res.Body)
+	case http.StatusNotFound:
+		return nil, errIconNotFound
+	default:
+		return nil, s3Error(res)
+	}
+}
+
+func (s *s3IconStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	res, err := s.do(ctx, http.MethodPut, key, data, contentType)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return s3Error(res)
+	}
+	return nil
+}
+
+func (s *s3IconStore) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return s3Error(res)
+	}
+}
+
+func s3Error(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("s3 responded %d: %s", res.StatusCode, body)
+}
+
+// do はAWS Signature Version 4で署名したリクエストを送る
+func (s *s3IconStore) do(ctx context.Context, method, key string, body []byte, contentType string) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	headers := map[string]string{
+		"host":                 u.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if contentType != "" {
+		headers["content-type"] = contentType
+	}
+	names := make([]string, 0, len(headers))
+	for name, value := range headers {
+		names = append(names, name)
+		if name != "host" {
+			req.Header.Set(name, value)
+		}
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := dateStamp + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := sigV4SigningKey(s.secretAccessKey, dateStamp, s.region, "s3")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKeyID, scope, signedHeaders, signature))
+
+	return s.client.Do(req)
+}
+
+// sigV4SigningKey は署名に使う鍵を日付・リージョン・サービスから導出する
+func sigV4SigningKey(secretAccessKey, dateStamp, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), dateStamp)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 はパス形式のリクエストを受けるMinIOの代わり。
+// 受け取ったリクエストの署名を仕様どおりに検証し、合わなければ403を返す
+type fakeS3 struct {
+	t               *testing.T
+	bucket          string
+	accessKeyID     string
+	secretAccessKey string
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	types    map[string]string
+	requests []string
+}
+
+var sigV4AuthorizationPattern = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, SignedHeaders=([a-z0-9;-]+), Signature=([0-9a-f]{64})$`)
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := f.verifySignature(r, body); err != nil {
+		f.t.Logf("signature rejected: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	prefix := "/" + f.bucket + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[key] = body
+		f.types[key] = r.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[key])
+		_, _ = w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) verifySignature(r *http.Request, body []byte) error {
+	m := sigV4AuthorizationPattern.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		return errors.New("malformed Authorization header: " + r.Header.Get("Authorization"))
+	}
+	accessKeyID, dateStamp, region, signedHeaders, signature := m[1], m[2], m[3], m[4], m[5]
+	if accessKeyID != f.accessKeyID {
+		return errors.New("unknown access key " + accessKeyID)
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if _, err := time.Parse("20060102T150405Z", amzDate); err != nil || !strings.HasPrefix(amzDate, dateStamp) {
+		return errors.New("x-amz-date does not match the credential scope: " + amzDate)
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash != sha256Hex(body) {
+		return errors.New("x-amz-content-sha256 does not match the body")
+	}
+
+	names := strings.Split(signedHeaders, ";")
+	for _, required := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !strings.Contains(";"+signedHeaders+";", ";"+required+";") {
+			return errors.New("unsigned header " + required)
+		}
+	}
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonicalRequest := r.Method + "\n" +
+		r.URL.EscapedPath() + "\n" +
+		r.URL.RawQuery + "\n" +
+		canonicalHeaders.String() + "\n" +
+		signedHeaders + "\n" +
+		payloadHash
+	scope := dateStamp + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := sigV4SigningKey(f.secretAccessKey, dateStamp, region, "s3")
+	if want := hex.EncodeToString(hmacSHA256(key, stringToSign)); signature != want {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func startFakeS3(t *testing.T, secretAccessKey string) (*fakeS3, *s3IconStore) {
+	t.Helper()
+
+	fake := &fakeS3{
+		t:               t,
+		bucket:          "icons",
+		accessKeyID:     "AKIDEXAMPLE",
+		secretAccessKey: "server-secret",
+		objects:         map[string][]byte{},
+		types:           map[string]string{},
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	endpoint, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &s3IconStore{
+		endpoint:        endpoint,
+		bucket:          "icons",
+		region:          "us-east-1",
+		accessKeyID:     "AKIDEXAMPLE",
+		secretAccessKey: secretAccessKey,
+		client:          server.Client(),
+	}
+	return fake, store
+}
+
+// AWSのドキュメントにある導出例
+func TestSigV4SigningKey(t *testing.T) {
+	key := sigV4SigningKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	if got, want := hex.EncodeToString(key), "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"; got != want {
+		t.Errorf("signing key = %s, want %s", got, want)
+	}
+}
+
+func TestS3IconStorePutGetDelete(t *testing.T) {
+	fake, store := startFakeS3(t, "server-secret")
+	ctx := context.Background()
+	data := []byte("\x89PNG fake image")
+
+	if err := store.Put(ctx, "abc.png", data, "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := fake.types["abc.png"]; got != "image/png" {
+		t.Errorf("stored content type = %q, want image/png", got)
+	}
+
+	got, err := store.Get(ctx, "abc.png")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Get = %q, want %q", got, data)
+	}
+
+	if err := store.Delete(ctx, "abc.png"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, "abc.png"); !errors.Is(err, errIconNotFound) {
+		t.Errorf("Get after Delete: got %v, want errIconNotFound", err)
+	}
+	// 存在しないキーを消してもエラーにしない
+	if err := store.Delete(ctx, "abc.png"); err != nil {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+
+	want := []string{
+		"PUT /icons/abc.png",
+		"GET /icons/abc.png",
+		"DELETE /icons/abc.png",
+		"GET /icons/abc.png",
+		"DELETE /icons/abc.png",
+	}
+	if strings.Join(fake.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requests = %q, want %q", fake.requests, want)
+	}
+}
+
+func TestS3IconStoreRejectsWrongSecret(t *testing.T) {
+	fake, store := startFakeS3(t, "wrong-secret")
+
+	err := store.Put(context.Background(), "abc.png", []byte("x"), "image/png")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Put: got %v, want a 403 error", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("objects = %v, want none", fake.objects)
+	}
+}
+
+func TestLocalIconStoreConcurrentPut(t *testing.T) {
+	store := &localIconStore{dir: t.TempDir()}
+	ctx := context.Background()
+
+	// 同じキーに並行して書いても、どちらかの内容がそのまま残る
+	contents := [][]byte{bytes.Repeat([]byte("a"), 1<<20), bytes.Repeat([]byte("b"), 1<<20)}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(data []byte) {
+			defer wg.Done()
+			if err := store.Put(ctx, "abc.png", data, "image/png"); err != nil {
+				t.Errorf("Put: %v", err)
+			}
+		}(contents[i%2])
+	}
+	wg.Wait()
+
+	got, err := store.Get(ctx, "abc.png")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !bytes.Equal(got, contents[0]) && !bytes.Equal(got, contents[1]) {
+		t.Errorf("Get returned a mix of concurrent writes")
+	}
+
+	if err := store.Delete(ctx, "abc.png"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, "abc.png"); !errors.Is(err, errIconNotFound) {
+		t.Errorf("Get after Delete: got %v, want errIconNotFound", err)
+	}
+	// 一時ファイルが残っていない
+	if entries, _ := os.ReadDir(store.dir); len(entries) != 0 {
+		t.Errorf("files left in the icon directory: %v", entries)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// stripedImage は左・中央・右を赤・青・緑に塗った画像。中央を正方形に切り抜くと青だけが残る
+func stripedImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		c := color.RGBA{0, 0, 255, 255}
+		switch {
+		case x < (width-height)/2:
+			c = color.RGBA{255, 0, 0, 255}
+		case x >= (width+height)/2:
+			c = color.RGBA{0, 255, 0, 255}
+		}
+		for y := 0; y < height; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodeTestImage(t *testing.T, format string, img image.Image) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100})
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatalf("encode %s: %v", format, err)
+	}
+	return buf.Bytes()
+}
+
+func TestNormalizeIcon(t *testing.T) {
+	tests := []struct {
+		format          string
+		width, height   int
+		wantContentType string
+	}{
+		{"png", 300, 100, "image/png"},
+		{"jpeg", 300, 100, "image/jpeg"},
+		{"gif", 300, 100, "image/png"},
+		{"png", 16, 16, "image/png"},
+		{"png", 100, 100, "image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %dx%d", tt.format, tt.width, tt.height), func(t *testing.T) {
+			data := encodeTestImage(t, tt.format, stripedImage(tt.width, tt.height))
+
+			icon, err := normalizeIcon(data)
+			if err != nil {
+				t.Fatalf("normalizeIcon: %v", err)
+			}
+			if icon.ContentType != tt.wantContentType {
+				t.Errorf("content type = %s, want %s", icon.ContentType, tt.wantContentType)
+			}
+			if len(icon.Images) != len(iconSizes) {
+				t.Fatalf("got %d sizes, want %d", len(icon.Images), len(iconSizes))
+			}
+
+			for _, size := range iconSizes {
+				img, format, err := image.Decode(bytes.NewReader(icon.Images[size]))
+				if err != nil {
+					t.Fatalf("decode size %d: %v", size, err)
+				}
+				if "image/"+format != icon.ContentType {
+					t.Errorf("size %d is encoded as %s, want %s", size, format, icon.ContentType)
+				}
+				if b := img.Bounds(); b.Dx() != size || b.Dy() != size {
+					t.Errorf("size %d is %dx%d", size, b.Dx(), b.Dy())
+				}
+				// 中央の青だけが残っている
+				for _, p := range []image.Point{{0, 0}, {size / 2, size / 2}, {size - 1, size - 1}} {
+					r, g, b, _ := img.At(p.X, p.Y).RGBA()
+					if r>>8 > 64 || g>>8 > 64 || b>>8 < 192 {
+						t.Errorf("size %d pixel %v = (%d, %d, %d), want blue", size, p, r>>8, g>>8, b>>8)
+					}
+				}
+			}
+
+			sum := sha256.Sum256(icon.Images[defaultIconSize])
+			if icon.Hash() != fmt.Sprintf("%x", sum) {
+				t.Errorf("Hash() is not the hash of the %dpx image", defaultIconSize)
+			}
+			// 同じ画像なら同じハッシュになり、重複して保存しない
+			again, err := normalizeIcon(data)
+			if err != nil {
+				t.Fatalf("normalizeIcon again: %v", err)
+			}
+			if again.Hash() != icon.Hash() {
+				t.Error("normalizing the same image twice gave different hashes")
+			}
+		})
+	}
+}
+
+func TestNormalizeIconRejectsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data func(t *testing.T) []byte
+	}{
+		{"empty", func(t *testing.T) []byte { return nil }},
+		{"too many bytes", func(t *testing.T) []byte { return make([]byte, maxIconBytes+1) }},
+		{"not an image", func(t *testing.T) []byte { return []byte("this is not an image") }},
+		{"truncated png", func(t *testing.T) []byte { return encodeTestImage(t, "png", stripedImage(100, 100))[:60] }},
+		{"too small", func(t *testing.T) []byte {
+			return encodeTestImage(t, "png", stripedImage(minIconDimension-1, minIconDimension-1))
+		}},
+		{"too wide", func(t *testing.T) []byte {
+			return encodeTestImage(t, "png", image.NewGray(image.Rect(0, 0, maxIconDimension+1, minIconDimension)))
+		}},
+		{"too thin", func(t *testing.T) []byte {
+			return encodeTestImage(t, "png", image.NewGray(image.Rect(0, 0, 100, minIconDimension-1)))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			icon, err := normalizeIcon(tt.data(t))
+			if !errors.Is(err, errInvalidIcon) {
+				t.Errorf("normalizeIcon = (%v, %v), want errInvalidIcon", icon, err)
+			}
+		})
+	}
+}
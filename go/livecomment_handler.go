@@ -6,7 +6,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
@@ -57,6 +59,25 @@ type ModerateRequest struct {
 	NGWord string `json:"ng_word"`
 }
 
+// ライブコメントのストリーミング配信で流れるイベント
+const (
+	livecommentEventPosted  = "livecomment"
+	livecommentEventTip     = "tip"
+	livecommentEventDeleted = "livecomment_deleted"
+)
+
+// ライブストリームのIDをappendして使うこと
+const livecommentChannelRedisKeyPrefix = "livecomment_channel:"
+
+// Last-Event-IDからの再送で一度に送る最大件数
+const livecommentStreamBackfillLimit = 1000
+
+type LivecommentEvent struct {
+	Type           string       `json:"type"`
+	Livecomment    *Livecomment `json:"livecomment,omitempty"`
+	LivecommentIDs []int64      `json:"livecomment_ids,omitempty"`
+}
+
 type NGWord struct {
 	ID           int64  `json:"id" db:"id"`
 	UserID       int64  `json:"user_id" db:"user_id"`
@@ -78,30 +99,39 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
+	page, err := parsePagination(c, 2)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil) // FIXME: selectのみtxn
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	// FIXME: index効いてるかどうかみてくれ
-	query := "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC"
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
-	}
+	// (created_at, id) のカーソルで livestream_id_and_created_at のindexを使う
+	query, args := page.Apply("SELECT * FROM livecomments WHERE livestream_id = ?", []interface{}{livestreamID}, "created_at", "id")
 
 	livecommentModels := []LivecommentModel{}
-	err = tx.SelectContext(ctx, &livecommentModels, query, livestreamID)
+	err = tx.SelectContext(ctx, &livecommentModels, query, args...)
 	if errors.Is(err, sql.ErrNoRows) {
-		return c.JSON(http.StatusOK, []*Livecomment{})
+		return respondArrayPage(c, []Livecomment{}, nil)
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 	}
+	if page.Forward() {
+		slices.Reverse(livecommentModels)
+	}
+	var next pageCursor
+	if page.HasNext(len(livecommentModels)) {
+		last := livecommentModels[len(livecommentModels)-1]
+		if page.Forward() {
+			last = livecommentModels[0]
+		}
+		next = pageCursor{last.CreatedAt, last.ID}
+	}
 
 	livecomments := make([]Livecomment, len(livecommentModels))
 	for i := range livecommentModels {
@@ -118,7 +148,150 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livecomments)
+	return respondArrayPage(c, livecomments, next)
+}
+
+// ライブコメントのストリーミング (Server-Sent Events)
+// GET /api/livestream/:livestream_id/livecomment/stream
+func getLivecommentStreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var lastSentID int64
+	if v := lastEventID(c); v != "" {
+		lastSentID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || lastSentID < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Last-Event-ID must be a non-negative integer")
+		}
+	}
+
+	var exists bool
+	if err := dbConn.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM livestreams WHERE id = ?)", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+	}
+
+	// 再送より先に購読しておかないと、再送中に投稿されたコメントを取りこぼす
+	pubsub := redisClient.Subscribe(ctx, fmt.Sprintf("%s%d", livecommentChannelRedisKeyPrefix, livestreamID))
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to subscribe livecomments: "+err.Error())
+	}
+
+	var backfill []Livecomment
+	if lastSentID > 0 {
+		backfill, err = getLivecommentsAfter(ctx, int64(livestreamID), lastSentID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		}
+	}
+
+	startSSE(c)
+
+	// 購読を始めてから再送するまでに投稿されたコメントは再送と購読の両方から届くので、再送したIDを覚えておく
+	backfilled := make(map[int64]bool, len(backfill))
+	for i := range backfill {
+		if err := writeLivecommentEvent(c, LivecommentEvent{Type: livecommentEventType(backfill[i]), Livecomment: &backfill[i]}); err != nil {
+			return nil
+		}
+		backfilled[backfill[i].ID] = true
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			if err := writeSSEHeartbeat(c); err != nil {
+				return nil
+			}
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			var event LivecommentEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				c.Logger().Warnf("failed to decode livecomment event: %+v", err)
+				continue
+			}
+			// 再送済みのコメントは送らない。
+			// コミットの順はIDの順と一致しないので、先に送ったコメントよりIDが小さくても再送していなければ送る
+			if event.Livecomment != nil && backfilled[event.Livecomment.ID] {
+				delete(backfilled, event.Livecomment.ID)
+				continue
+			}
+			if err := writeLivecommentEvent(c, event); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+func getLivecommentsAfter(ctx context.Context, livestreamID int64, afterID int64) ([]Livecomment, error) {
+	tx, err := dbConn.BeginTxx(ctx, nil) // FIXME: selectのみtxn
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var livecommentModels []LivecommentModel
+	if err := tx.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE livestream_id = ? AND id > ? ORDER BY id ASC LIMIT ?", livestreamID, afterID, livecommentStreamBackfillLimit); err != nil {
+		return nil, err
+	}
+
+	livecomments := make([]Livecomment, len(livecommentModels))
+	for i := range livecommentModels {
+		// FIXME: 2N+1
+		livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModels[i])
+		if err != nil {
+			return nil, err
+		}
+		livecomments[i] = livecomment
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return livecomments, nil
+}
+
+func livecommentEventType(livecomment Livecomment) string {
+	if livecomment.Tip > 0 {
+		return livecommentEventTip
+	}
+	return livecommentEventPosted
+}
+
+func writeLivecommentEvent(c echo.Context, event LivecommentEvent) error {
+	// 削除イベントにはidを付けない (Last-Event-IDはコメントのIDだけで進める)
+	id := ""
+	if event.Livecomment != nil {
+		id = strconv.FormatInt(event.Livecomment.ID, 10)
+	}
+	return writeSSEEvent(c, id, event.Type, event)
+}
+
+func publishLivecommentEvent(ctx context.Context, livestreamID int64, event LivecommentEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return redisClient.Publish(ctx, fmt.Sprintf("%s%d", livecommentChannelRedisKeyPrefix, livestreamID), payload).Err()
 }
 
 func getNgwords(c echo.Context) error {
@@ -144,9 +317,24 @@ func getNgwords(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	// NGワードは配信者のものとして登録されているので、コラボレーターには配信者のNGワードを返す
+	ngWordUserID := userID
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err == nil {
+		isHost, err := isLivestreamHost(ctx, tx, livestreamModel, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+		}
+		if isHost {
+			ngWordUserID = livestreamModel.UserID
+		}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
 	var ngWords []*NGWord
 	// FIXME: indexきいてるかどうかみてくれ
-	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC", userID, livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC", ngWordUserID, livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.JSON(http.StatusOK, []*NGWord{})
 		} else {
@@ -198,6 +386,9 @@ func postLivecommentHandler(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 		}
 	}
+	if err := verifyLivestreamAcceptsActivity(livestreamModel); err != nil {
+		return err
+	}
 
 	// スパム判定
 	var ngwords []*NGWord
@@ -261,7 +452,11 @@ func postLivecommentHandler(c echo.Context) error {
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to incr the leader board: "+err.Error())
 		}
-		err = redisClient.ZIncrBy(ctx, UserLeaderBoardRedisKey, float64(req.Tip), strconv.FormatInt(livestreamModel.UserID, 10)).Err()
+		livestreamTips, err := redisClient.IncrBy(ctx, fmt.Sprintf("%s%d", livestreamTipsCachePrefix, livestreamID), req.Tip).Result()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to incr the livestream tips: "+err.Error())
+		}
+		err = incrUserLeaderBoardForHosts(ctx, livestreamModel, livestreamTips-req.Tip, livestreamTips)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to incr the leader board: "+err.Error())
 		}
@@ -271,6 +466,25 @@ func postLivecommentHandler(c echo.Context) error {
 		}
 	}
 
+	// ライブコメントはコミット済みなので、配信できなくても投稿は成功として返す。
+	// ストリームのクライアントは再接続したときにLast-Event-IDから再送を受けられる
+	if err := publishLivecommentEvent(ctx, int64(livestreamID), LivecommentEvent{
+		Type:        livecommentEventType(livecomment),
+		Livecomment: &livecomment,
+	}); err != nil {
+		log.Printf("failed to publish livecomment %d: %+v", livecomment.ID, err)
+	}
+
+	// ライブコメントはコミット済みなので、Webhookを積めなくても投稿は成功として返す
+	if err := enqueueWebhookEvent(ctx, livestreamModel.UserID, webhookEventLivecommentPosted, livecomment); err != nil {
+		log.Printf("failed to enqueue %s webhook for livecomment %d: %+v", webhookEventLivecommentPosted, livecomment.ID, err)
+	}
+	if livecomment.Tip > 0 {
+		if err := enqueueWebhookEvent(ctx, livestreamModel.UserID, webhookEventTipReceived, livecomment); err != nil {
+			log.Printf("failed to enqueue %s webhook for livecomment %d: %+v", webhookEventTipReceived, livecomment.ID, err)
+		}
+	}
+
 	return c.JSON(http.StatusCreated, livecomment)
 }
 
@@ -350,6 +564,11 @@ func reportLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to incr spam count: "+err.Error())
 	}
 
+	// 通報はコミット済みなので、Webhookを積めなくても通報は成功として返す
+	if err := enqueueWebhookEvent(ctx, livestreamModel.UserID, webhookEventReportFiled, report); err != nil {
+		log.Printf("failed to enqueue %s webhook for report %d: %+v", webhookEventReportFiled, report.ID, err)
+	}
+
 	return c.JSON(http.StatusCreated, report)
 }
 
@@ -377,17 +596,25 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	// 配信者自身の配信に対するmoderateなのかを検証
-	var ownedLivestreams []LivestreamModel
-	if err := dbConn.SelectContext(ctx, &ownedLivestreams, "SELECT * FROM livestreams WHERE id = ? AND user_id = ?", livestreamID, userID); err != nil {
+	// 配信者自身かコラボレーターの配信に対するmoderateなのかを検証
+	var livestreamModel LivestreamModel
+	if err := dbConn.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
-	if len(ownedLivestreams) == 0 {
+	isHost, err := isLivestreamHost(ctx, dbConn, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+	}
+	if !isHost {
 		return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
 	}
 
+	// コメント投稿時のスパム判定は配信者のNGワードを見るので、コラボレーターが登録しても配信者のものとして保存する
 	rs, err := dbConn.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
-		UserID:       int64(userID),
+		UserID:       livestreamModel.UserID,
 		LivestreamID: int64(livestreamID),
 		Word:         req.NGWord,
 		CreatedAt:    time.Now().Unix(),
@@ -429,7 +656,11 @@ func moderateHandler(c echo.Context) error {
 				return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
 			}
 
-			err = redisClient.ZIncrBy(ctx, UserLeaderBoardRedisKey, -float64(tip), fmt.Sprintf("%d", userID)).Err()
+			livestreamTips, err := redisClient.DecrBy(ctx, fmt.Sprintf("%s%d", livestreamTipsCachePrefix, livestreamID), tip).Result()
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
+			}
+			err = incrUserLeaderBoardForHosts(ctx, livestreamModel, livestreamTips+tip, livestreamTips)
 			if err != nil {
 				return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
 			}
@@ -438,6 +669,12 @@ func moderateHandler(c echo.Context) error {
 
 	//for _, livecomment := range livecomments {
 	//	// FIXME: N+1
+	// ストリーミング視聴者に削除を通知するため、消す前にIDを控えておく
+	var deletedIDs []int64
+	if err := dbConn.SelectContext(ctx, &deletedIDs, "SELECT id FROM livecomments WHERE livestream_id = ? AND comment like concat('%', ?, '%')", livestreamID, req.NGWord); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get old livecomments that hit spams: "+err.Error())
+	}
+
 	query := `
 			DELETE FROM livecomments
 			WHERE
@@ -450,6 +687,15 @@ func moderateHandler(c echo.Context) error {
 	//}
 	//}
 
+	if len(deletedIDs) > 0 {
+		if err := publishLivecommentEvent(ctx, int64(livestreamID), LivecommentEvent{
+			Type:           livecommentEventDeleted,
+			LivecommentIDs: deletedIDs,
+		}); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to publish deleted livecomments: "+err.Error())
+		}
+	}
+
 	return c.JSON(http.StatusCreated, map[string]interface{}{
 		"word_id": wordID,
 	})
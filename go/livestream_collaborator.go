@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 1配信あたりのコラボレーターの上限
+const maxLivestreamCollaborators = 10
+
+type LivestreamCollaboratorModel struct {
+	LivestreamID int64 `db:"livestream_id"`
+	UserID       int64 `db:"user_id"`
+	CreatedAt    int64 `db:"created_at"`
+}
+
+// insertLivestreamCollaborators は配信にコラボレーターを登録する。
+// 配信者本人と重複は取り除き、存在しないユーザが含まれていればecho.HTTPErrorを返す
+func insertLivestreamCollaborators(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel, userIDs []int64) error {
+	collaboratorIDs := make([]int64, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if userID == livestreamModel.UserID || slices.Contains(collaboratorIDs, userID) {
+			continue
+		}
+		collaboratorIDs = append(collaboratorIDs, userID)
+	}
+	if len(collaboratorIDs) > maxLivestreamCollaborators {
+		return echo.NewHTTPError(http.StatusBadRequest, "a livestream can have at most "+strconv.Itoa(maxLivestreamCollaborators)+" collaborators")
+	}
+	if len(collaboratorIDs) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In("SELECT COUNT(*) FROM users WHERE id IN (?)", collaboratorIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var found int
+	if err := tx.GetContext(ctx, &found, tx.Rebind(query), args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborators: "+err.Error())
+	}
+	if found != len(collaboratorIDs) {
+		return echo.NewHTTPError(http.StatusBadRequest, "collaborators contain an unknown user")
+	}
+
+	now := time.Now().Unix()
+	collaboratorModels := make([]LivestreamCollaboratorModel, len(collaboratorIDs))
+	for i, userID := range collaboratorIDs {
+		collaboratorModels[i] = LivestreamCollaboratorModel{
+			LivestreamID: livestreamModel.ID,
+			UserID:       userID,
+			CreatedAt:    now,
+		}
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_collaborators (livestream_id, user_id, created_at) VALUES (:livestream_id, :user_id, :created_at)", collaboratorModels); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream collaborators: "+err.Error())
+	}
+	return nil
+}
+
+// getLivestreamCollaboratorIDs は配信のコラボレーターのユーザIDを登録順に返す
+func getLivestreamCollaboratorIDs(ctx context.Context, db sqlx.QueryerContext, livestreamID int64) ([]int64, error) {
+	var userIDs []int64
+	if err := sqlx.SelectContext(ctx, db, &userIDs, "SELECT user_id FROM livestream_collaborators WHERE livestream_id = ? ORDER BY created_at, user_id", livestreamID); err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+// isLivestreamHost は配信者本人かコラボレーターであればtrueを返す。
+// ホストはNGワードの登録やスパム報告の閲覧を配信者と同じようにできる
+func isLivestreamHost(ctx context.Context, db sqlx.QueryerContext, livestreamModel LivestreamModel, userID int64) (bool, error) {
+	if livestreamModel.UserID == userID {
+		return true, nil
+	}
+	var found int
+	err := sqlx.GetContext(ctx, db, &found, "SELECT 1 FROM livestream_collaborators WHERE livestream_id = ? AND user_id = ?", livestreamModel.ID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// splitAmongHosts はユーザ別の統計で、配信が受け取ったリアクション数やチップ額を各ホストに割り振る。
+// ホスト数で等分し、割り切れない余りは配信者本人に計上する
+func splitAmongHosts(total int64, hosts int64, isOwner bool) int64 {
+	if hosts <= 1 {
+		return total
+	}
+	share := total / hosts
+	if isOwner {
+		share += total % hosts
+	}
+	return share
+}
+
+// incrUserLeaderBoardForHosts は配信のリアクション数かチップ合計がbeforeからafterに変わったときに、
+// ホスト全員のユーザリーダーボードに splitAmongHosts で割り振った分の差を加算する。
+// 1件ずつ割り振ると割り切れない分がコラボレーターに入らないので、getUserCredits と同じく配信の合計から割り振り直す
+func incrUserLeaderBoardForHosts(ctx context.Context, livestreamModel LivestreamModel, before, after int64) error {
+	collaboratorIDs, err := getLivestreamCollaboratorIDs(ctx, dbConn, livestreamModel.ID)
+	if err != nil {
+		return err
+	}
+	return incrUserLeaderBoardForHostIDs(ctx, livestreamModel.UserID, collaboratorIDs, before, after)
+}
+
+func incrUserLeaderBoardForHostIDs(ctx context.Context, ownerID int64, collaboratorIDs []int64, before, after int64) error {
+	hosts := int64(len(collaboratorIDs) + 1)
+	if delta := splitAmongHosts(after, hosts, true) - splitAmongHosts(before, hosts, true); delta != 0 {
+		err := redisClient.ZIncrBy(ctx, UserLeaderBoardRedisKey, float64(delta), strconv.FormatInt(ownerID, 10)).Err()
+		if err != nil {
+			return err
+		}
+	}
+	if delta := splitAmongHosts(after, hosts, false) - splitAmongHosts(before, hosts, false); delta != 0 {
+		for _, userID := range collaboratorIDs {
+			err := redisClient.ZIncrBy(ctx, UserLeaderBoardRedisKey, float64(delta), strconv.FormatInt(userID, 10)).Err()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
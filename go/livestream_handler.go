@@ -7,8 +7,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/redis/go-redis/v9"
+	"log"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -27,6 +30,19 @@ type ReserveLivestreamRequest struct {
 	ThumbnailUrl string  `json:"thumbnail_url"`
 	StartAt      int64   `json:"start_at"`
 	EndAt        int64   `json:"end_at"`
+	// コラボレーターのユーザID。GET /api/user/:username で引いたユーザを指定する
+	Collaborators []int64 `json:"collaborators"`
+	// 指定すると、start_at, end_at を初回として繰り返し予約する
+	Recurrence *ReservationRecurrence `json:"recurrence,omitempty"`
+}
+
+// UpdateLivestreamRequest は指定されたフィールドだけを更新する
+type UpdateLivestreamRequest struct {
+	Title        *string  `json:"title"`
+	Description  *string  `json:"description"`
+	PlaylistUrl  *string  `json:"playlist_url"`
+	ThumbnailUrl *string  `json:"thumbnail_url"`
+	Tags         *[]int64 `json:"tags"`
 }
 
 type LivestreamViewerModel struct {
@@ -35,6 +51,14 @@ type LivestreamViewerModel struct {
 	CreatedAt    int64 `db:"created_at" json:"created_at"`
 }
 
+// ライブ配信の状態。DBには持たず、start_at, end_at, cancelled_at から計算する
+const (
+	livestreamStatusScheduled = "scheduled"
+	livestreamStatusLive      = "live"
+	livestreamStatusEnded     = "ended"
+	livestreamStatusCancelled = "cancelled"
+)
+
 type LivestreamModel struct {
 	ID           int64  `db:"id" json:"id"`
 	UserID       int64  `db:"user_id" json:"user_id"`
@@ -44,18 +68,75 @@ type LivestreamModel struct {
 	ThumbnailUrl string `db:"thumbnail_url" json:"thumbnail_url"`
 	StartAt      int64  `db:"start_at" json:"start_at"`
 	EndAt        int64  `db:"end_at" json:"end_at"`
+	// キャンセルされていなければ0
+	CancelledAt int64 `db:"cancelled_at" json:"cancelled_at"`
+	// 繰り返し予約でなければ0
+	SeriesID int64 `db:"series_id" json:"series_id"`
+	// 配信開始の通知を積んだ時刻。まだなら0
+	LiveNotifiedAt int64 `db:"live_notified_at" json:"live_notified_at"`
+}
+
+// Status は時刻nowにおける配信の状態を返す
+func (l LivestreamModel) Status(now int64) string {
+	switch {
+	case l.CancelledAt > 0:
+		return livestreamStatusCancelled
+	case now < l.StartAt:
+		return livestreamStatusScheduled
+	case now < l.EndAt:
+		return livestreamStatusLive
+	default:
+		return livestreamStatusEnded
+	}
+}
+
+// AcceptsActivity はライブコメント、リアクション、入室を受け付けるかどうか。
+// 配信中に加えて、開始前と終了後の猶予期間も受け付ける
+func (l LivestreamModel) AcceptsActivity(now int64) bool {
+	if l.CancelledAt > 0 {
+		return false
+	}
+	return l.StartAt-livestreamGracePeriod <= now && now < l.EndAt+livestreamGracePeriod
+}
+
+// verifyLivestreamAcceptsActivity は配信中でなければecho.HTTPErrorを返す
+func verifyLivestreamAcceptsActivity(livestreamModel LivestreamModel) error {
+	now := time.Now().Unix()
+	if !livestreamModel.AcceptsActivity(now) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("livestream is not live (status: %s)", livestreamModel.Status(now)))
+	}
+	return nil
+}
+
+// livestreamStatusCondition は状態で絞り込むWHERE句の条件を返す。aliasはlivestreamsテーブルの別名
+func livestreamStatusCondition(status string, now int64, alias string) (string, []interface{}, error) {
+	switch status {
+	case livestreamStatusScheduled:
+		return fmt.Sprintf("%[1]s.cancelled_at = 0 AND %[1]s.start_at > ?", alias), []interface{}{now}, nil
+	case livestreamStatusLive:
+		return fmt.Sprintf("%[1]s.cancelled_at = 0 AND %[1]s.start_at <= ? AND %[1]s.end_at > ?", alias), []interface{}{now, now}, nil
+	case livestreamStatusEnded:
+		return fmt.Sprintf("%[1]s.cancelled_at = 0 AND %[1]s.end_at <= ?", alias), []interface{}{now}, nil
+	case livestreamStatusCancelled:
+		return fmt.Sprintf("%s.cancelled_at > 0", alias), nil, nil
+	}
+	return "", nil, fmt.Errorf("unknown livestream status: %s", status)
 }
 
 type Livestream struct {
-	ID           int64  `json:"id"`
-	Owner        User   `json:"owner"`
-	Title        string `json:"title"`
-	Description  string `json:"description"`
-	PlaylistUrl  string `json:"playlist_url"`
-	ThumbnailUrl string `json:"thumbnail_url"`
-	Tags         []Tag  `json:"tags"`
-	StartAt      int64  `json:"start_at"`
-	EndAt        int64  `json:"end_at"`
+	ID    int64 `json:"id"`
+	Owner User  `json:"owner"`
+	// 配信者と同じようにモデレーションできる共同ホスト
+	Collaborators []User `json:"collaborators"`
+	Title         string `json:"title"`
+	Description   string `json:"description"`
+	PlaylistUrl   string `json:"playlist_url"`
+	ThumbnailUrl  string `json:"thumbnail_url"`
+	Tags          []Tag  `json:"tags"`
+	StartAt       int64  `json:"start_at"`
+	EndAt         int64  `json:"end_at"`
+	Status        string `json:"status"`
+	SeriesID      int64  `json:"series_id,omitempty"`
 }
 
 type LivestreamTagModel struct {
@@ -96,162 +177,285 @@ func reserveLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	// 2023/11/25 10:00からの１年間の期間内であるかチェック
-	var (
-		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
-		termEndAt      = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
-		reserveStartAt = time.Unix(req.StartAt, 0)
-		reserveEndAt   = time.Unix(req.EndAt, 0)
-	)
-	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
-		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	if req.Recurrence != nil {
+		return reserveLivestreamSeries(c, tx, userID, req)
 	}
 
-	// 予約枠をみて、予約が可能か調べる
-	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
-	var slots []*ReservationSlotModel
-	// FIXME: indexきいてるかみてくれ
-	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
-		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	livestreamModel, err := reserveLivestream(ctx, tx, userID, req, req.StartAt, req.EndAt, 0)
+	if err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
 	}
-	for _, slot := range slots {
-		var count int
-		// FIXME: N+1
-		if err := tx.GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", slot.StartAt, slot.EndAt); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
-		}
-		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
-		if count < 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
-		}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if err := cacheReservedLivestream(ctx, livestreamModel, req.Tags, &livestream); err != nil {
+		return err
+	}
+
+	// 予約はコミット済みなので、通知を積めなくても予約は成功として返す
+	if err := enqueueNotifications(ctx, notificationTypeReserved, livestreamModel); err != nil {
+		log.Printf("failed to enqueue notifications for livestream %d: %+v", livestreamModel.ID, err)
+	}
+
+	if err := enqueueWebhookEvent(ctx, userID, webhookEventLivestreamReserved, livestream); err != nil {
+		log.Printf("failed to enqueue %s webhook for livestream %d: %+v", webhookEventLivestreamReserved, livestream.ID, err)
+	}
+
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+// reserveLivestream は予約枠を確保して配信を1件登録する。
+// 失敗した場合はecho.HTTPErrorを返す
+func reserveLivestream(ctx context.Context, tx *sqlx.Tx, userID int64, req *ReserveLivestreamRequest, startAt, endAt int64, seriesID int64) (*LivestreamModel, error) {
+	terms, err := verifyReservationTerm(ctx, tx, startAt, endAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// 予約枠をみて、予約が可能か調べる
+	if err := claimReservationSlots(ctx, tx, terms, startAt, endAt); err != nil {
+		return nil, err
 	}
 
 	var (
 		livestreamModel = &LivestreamModel{
-			UserID:       int64(userID),
+			UserID:       userID,
 			Title:        req.Title,
 			Description:  req.Description,
 			PlaylistUrl:  req.PlaylistUrl,
 			ThumbnailUrl: req.ThumbnailUrl,
-			StartAt:      req.StartAt,
-			EndAt:        req.EndAt,
+			StartAt:      startAt,
+			EndAt:        endAt,
+			SeriesID:     seriesID,
 		}
 	)
 
-	// FIXME: indexきいてるかみてくれ
-	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
-	}
-
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, series_id) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at, :series_id)", livestreamModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
 	}
 
 	livestreamID, err := rs.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
 	}
 	livestreamModel.ID = livestreamID
 
 	// タグ追加
-	cacheValues := make([]interface{}, len(req.Tags))
-	for i, tagID := range req.Tags {
+	if err := verifyTagIDs(ctx, tx, req.Tags); err != nil {
+		return nil, err
+	}
+	for _, tagID := range req.Tags {
 		// FIXME: N+1
 		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
 			LivestreamID: livestreamID,
 			TagID:        tagID,
 		}); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
 		}
-		cacheValues[i] = strconv.FormatInt(tagID, 10)
 	}
-	if len(cacheValues) > 0 {
-		err = redisClient.LPush(ctx, fmt.Sprintf("%s%d", LivestreamTagsCacheRedisKeyPrefix, livestreamID), cacheValues...).Err()
+
+	if err := insertLivestreamCollaborators(ctx, tx, livestreamModel, req.Collaborators); err != nil {
+		return nil, err
 	}
-	if err != nil {
+
+	return livestreamModel, nil
+}
+
+// cacheReservedLivestream はコミット後に、予約した配信をリーダーボードやタグなどのキャッシュに載せる。
+// タグのキャッシュが入るまで fillLivestreamResponse はタグを返さないので、レスポンスのタグも入れ直す
+func cacheReservedLivestream(ctx context.Context, livestreamModel *LivestreamModel, tagIDs []int64, livestream *Livestream) error {
+	if err := cacheLivestreamTags(ctx, livestreamModel.ID, tagIDs); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag cache: "+err.Error())
 	}
-
-	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	tags, err := getLivestreamTags(ctx, livestreamModel.ID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
 	}
+	livestream.Tags = tags
 
 	z := redis.Z{
 		Score:  0,
-		Member: strconv.FormatInt(livestreamID, 10),
+		Member: strconv.FormatInt(livestreamModel.ID, 10),
 	}
 	err = redisClient.ZAdd(ctx, LivestreamLeaderBoardRedisKey, z).Err()
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to make zset entry: "+err.Error())
 	}
 
-	err = redisClient.Set(ctx, fmt.Sprintf("%s%d", livestreamID2UserIDCachePrefix, livestreamID), strconv.FormatInt(userID, 10), 1*time.Hour).Err()
+	err = redisClient.Set(ctx, fmt.Sprintf("%s%d", livestreamID2UserIDCachePrefix, livestreamModel.ID), strconv.FormatInt(livestreamModel.UserID, 10), 1*time.Hour).Err()
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to make livestream2user cache: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, livestream)
+	return nil
 }
 
+// 検索結果の並び順
+const (
+	// 新しく予約された順
+	livestreamSortNewest = "newest"
+	// リーダーボードのスコア (リアクション数とチップの合計) が多い順
+	livestreamSortReactions = "reactions"
+	// まだ始まっていない配信を開始が近い順
+	livestreamSortStartingSoon = "starting_soon"
+)
+
+// 複数のタグを指定したときの組み合わせ方
+const (
+	tagModeAnd = "and"
+	tagModeOr  = "or"
+)
+
+// GET /api/livestream/search
+//
+//	tag: 複数指定可。tag_mode=and (デフォルト) ならすべてのタグ、orならいずれかのタグが付いた配信
+//	q: タイトルか説明文に含まれるキーワード。空白区切りですべてを含むもの
+//	username: 配信者
+//	from, to: この期間に少しでもかかる配信
+//	status: scheduled, live, ended, cancelled
+//	sort: newest (デフォルト), reactions, starting_soon
 func searchLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	keyTagName := c.QueryParam("tag")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	sortOrder := c.QueryParam("sort")
+	if sortOrder == "" {
+		sortOrder = livestreamSortNewest
+	}
+	cursorKeys := 1
+	switch sortOrder {
+	case livestreamSortNewest:
+	case livestreamSortReactions, livestreamSortStartingSoon:
+		cursorKeys = 2
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "sort query parameter must be one of newest, reactions or starting_soon")
+	}
+
+	page, err := parsePagination(c, cursorKeys)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return err
 	}
-	defer tx.Rollback()
 
-	var livestreamModels []*LivestreamModel
-	if c.QueryParam("tag") != "" {
-		tagIDStr, err := redisClient.Get(ctx, Name2TagIDCacheRedisKeyPrefix+keyTagName).Result()
+	now := time.Now().Unix()
+	var (
+		conditions = ""
+		condArgs   []interface{}
+	)
+	if status := c.QueryParam("status"); status != "" {
+		cond, args, err := livestreamStatusCondition(status, now, "l")
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+			return echo.NewHTTPError(http.StatusBadRequest, "status query parameter must be one of scheduled, live, ended or cancelled")
 		}
-		tagID, _ := strconv.ParseInt(tagIDStr, 10, 64)
+		conditions += " AND " + cond
+		condArgs = append(condArgs, args...)
+	}
 
-		// FIXME: indexきいてるかみてくれ
-		query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE tag_id = ? ORDER BY livestream_id DESC", tagID)
+	if tagNames := c.QueryParams()["tag"]; len(tagNames) > 0 {
+		cond, args, ok, err := livestreamTagCondition(ctx, tagNames, c.QueryParam("tag_mode"))
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+			return err
 		}
-		var keyTaggedLivestreams []*LivestreamTagModel
-		if err := tx.SelectContext(ctx, &keyTaggedLivestreams, query, params...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreams: "+err.Error())
+		if !ok {
+			// 存在しないタグで絞り込んでいるので、該当する配信はない
+			return respondArrayPage(c, []Livestream{}, nil)
 		}
+		conditions += " AND " + cond
+		condArgs = append(condArgs, args...)
+	}
 
-		for _, keyTaggedLivestream := range keyTaggedLivestreams {
-			ls := LivestreamModel{}
-			// FIXME: N+1
-			if err := tx.GetContext(ctx, &ls, "SELECT * FROM livestreams WHERE id = ?", keyTaggedLivestream.LivestreamID); err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-			}
+	for _, keyword := range strings.Fields(c.QueryParam("q")) {
+		pattern := "%" + escapeLikePattern(keyword) + "%"
+		conditions += " AND (l.title LIKE ? OR l.description LIKE ?)"
+		condArgs = append(condArgs, pattern, pattern)
+	}
 
-			livestreamModels = append(livestreamModels, &ls)
-		}
-	} else {
-		// 検索条件なし
+	if username := c.QueryParam("username"); username != "" {
+		conditions += " AND l.user_id = (SELECT id FROM users WHERE name = ?)"
+		condArgs = append(condArgs, username)
+	}
+
+	from, err := parseUnixQueryParam(c, "from", 0)
+	if err != nil {
+		return err
+	}
+	if from > 0 {
+		conditions += " AND l.end_at > ?"
+		condArgs = append(condArgs, from)
+	}
+	to, err := parseUnixQueryParam(c, "to", 0)
+	if err != nil {
+		return err
+	}
+	if to > 0 {
+		conditions += " AND l.start_at < ?"
+		condArgs = append(condArgs, to)
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var (
+		livestreamModels []*LivestreamModel
+		nextCursor       func(*LivestreamModel) pageCursor
+	)
+	switch sortOrder {
+	case livestreamSortNewest:
 		// FIXME: LIMIT無し挙動の時の時に本当に全部取る必要あるのか？？？？？
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
-		if c.QueryParam("limit") != "" {
-			limit, err := strconv.Atoi(c.QueryParam("limit"))
-			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-			}
-			query += fmt.Sprintf(" LIMIT %d", limit)
+		query, params := page.Apply("SELECT l.* FROM livestreams l WHERE 1 = 1"+conditions, condArgs, "l.id")
+		if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 		}
-
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
+		if page.Forward() {
+			slices.Reverse(livestreamModels)
+		}
+		nextCursor = func(l *LivestreamModel) pageCursor { return pageCursor{l.ID} }
+	case livestreamSortStartingSoon:
+		query, params := page.ApplyAsc(
+			"SELECT l.* FROM livestreams l WHERE l.cancelled_at = 0 AND l.start_at > ?"+conditions,
+			append([]interface{}{now}, condArgs...),
+			"l.start_at", "l.id",
+		)
+		if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 		}
+		if page.Forward() {
+			slices.Reverse(livestreamModels)
+		}
+		nextCursor = func(l *LivestreamModel) pageCursor { return pageCursor{l.StartAt, l.ID} }
+	case livestreamSortReactions:
+		// スコアはRedisにしかないので、条件に合う配信を全部引いてからアプリで並べる
+		// FIXME: 配信が増えたらきつい
+		if err := tx.SelectContext(ctx, &livestreamModels, "SELECT l.* FROM livestreams l WHERE 1 = 1"+conditions, condArgs...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		scores, err := getLivestreamLeaderBoardScores(ctx, livestreamModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to retrieve the livestreaming leader board: "+err.Error())
+		}
+		nextCursor = func(l *LivestreamModel) pageCursor { return pageCursor{scores[l.ID], l.ID} }
+		slices.SortFunc(livestreamModels, func(a, b *LivestreamModel) int {
+			return compareCursor(nextCursor(b), nextCursor(a))
+		})
+		livestreamModels = applyPageToSlice(page, livestreamModels, nextCursor)
+	}
+	var next pageCursor
+	if page.HasNext(len(livestreamModels)) {
+		last := livestreamModels[len(livestreamModels)-1]
+		if page.Forward() {
+			last = livestreamModels[0]
+		}
+		next = nextCursor(last)
 	}
 
 	livestreams := make([]Livestream, len(livestreamModels))
@@ -268,7 +472,84 @@ func searchLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return respondArrayPage(c, livestreams, next)
+}
+
+// livestreamTagCondition はタグ名で絞り込むWHERE句の条件を返す。
+// 存在しないタグのせいで該当する配信がありえないときはokがfalseになる
+func livestreamTagCondition(ctx context.Context, tagNames []string, mode string) (string, []interface{}, bool, error) {
+	if mode == "" {
+		mode = tagModeAnd
+	}
+	if mode != tagModeAnd && mode != tagModeOr {
+		return "", nil, false, echo.NewHTTPError(http.StatusBadRequest, "tag_mode query parameter must be and or or")
+	}
+
+	cacheKeys := make([]string, len(tagNames))
+	for i, tagName := range tagNames {
+		cacheKeys[i] = Name2TagIDCacheRedisKeyPrefix + tagName
+	}
+	tagIDStrs, err := redisClient.MGet(ctx, cacheKeys...).Result()
+	if err != nil {
+		return "", nil, false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+
+	var tagIDs []int64
+	for _, tagIDStr := range tagIDStrs {
+		if tagIDStr == nil {
+			if mode == tagModeAnd {
+				return "", nil, false, nil
+			}
+			continue
+		}
+		tagID, _ := strconv.ParseInt(tagIDStr.(string), 10, 64)
+		if !slices.Contains(tagIDs, tagID) {
+			tagIDs = append(tagIDs, tagID)
+		}
+	}
+	if len(tagIDs) == 0 {
+		return "", nil, false, nil
+	}
+
+	// tag_id_and_livestream_id のindexを使う
+	query := "l.id IN (SELECT livestream_id FROM livestream_tags WHERE tag_id IN (?)"
+	args := []interface{}{tagIDs}
+	if mode == tagModeAnd {
+		query += " GROUP BY livestream_id HAVING COUNT(DISTINCT tag_id) = ?"
+		args = append(args, len(tagIDs))
+	}
+	query += ")"
+	query, args, err = sqlx.In(query, args...)
+	if err != nil {
+		return "", nil, false, echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	return query, args, true, nil
+}
+
+// escapeLikePattern はLIKEのワイルドカードとして扱われる文字をエスケープする
+func escapeLikePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// getLivestreamLeaderBoardScores はリーダーボードのスコアを配信IDごとに返す
+func getLivestreamLeaderBoardScores(ctx context.Context, livestreamModels []*LivestreamModel) (map[int64]int64, error) {
+	scores := make(map[int64]int64, len(livestreamModels))
+	if len(livestreamModels) == 0 {
+		return scores, nil
+	}
+
+	members := make([]string, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		members[i] = strconv.FormatInt(livestreamModel.ID, 10)
+	}
+	values, err := redisClient.ZMScore(ctx, LivestreamLeaderBoardRedisKey, members...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, livestreamModel := range livestreamModels {
+		scores[livestreamModel.ID] = int64(values[i])
+	}
+	return scores, nil
 }
 
 func getMyLivestreamsHandler(c echo.Context) error {
@@ -380,6 +661,17 @@ func enterLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if err := verifyLivestreamAcceptsActivity(livestreamModel); err != nil {
+		return err
+	}
+
 	viewer := LivestreamViewerModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
@@ -496,6 +788,154 @@ func getLivestreamHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, livestream)
 }
 
+// 配信のタイトルやタグなどの編集
+// PATCH /api/livestream/:livestream_id
+func updateLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	req := UpdateLivestreamRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't update other streamer's livestream")
+	}
+
+	if req.Title != nil {
+		livestreamModel.Title = *req.Title
+	}
+	if req.Description != nil {
+		livestreamModel.Description = *req.Description
+	}
+	if req.PlaylistUrl != nil {
+		livestreamModel.PlaylistUrl = *req.PlaylistUrl
+	}
+	if req.ThumbnailUrl != nil {
+		livestreamModel.ThumbnailUrl = *req.ThumbnailUrl
+	}
+	if _, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET title = :title, description = :description, playlist_url = :playlist_url, thumbnail_url = :thumbnail_url WHERE id = :id", livestreamModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+
+	var tagIDs []int64
+	if req.Tags != nil {
+		for _, tagID := range *req.Tags {
+			if !slices.Contains(tagIDs, tagID) {
+				tagIDs = append(tagIDs, tagID)
+			}
+		}
+		if err := verifyTagIDs(ctx, tx, tagIDs); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ?", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+		}
+		for _, tagID := range tagIDs {
+			// FIXME: N+1
+			if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
+				LivestreamID: livestreamID,
+				TagID:        tagID,
+			}); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+			}
+		}
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if req.Tags != nil {
+		// 検索はlivestream_tagsを、レスポンスはキャッシュを見るので、コミットしてからキャッシュも置き換える
+		if err := cacheLivestreamTags(ctx, livestreamID, tagIDs); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream tag cache: "+err.Error())
+		}
+		if livestream.Tags, err = getLivestreamTags(ctx, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
+		}
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// verifyTagIDs はタグIDがすべてtagsに存在し、廃止されていないかをチェックする
+func verifyTagIDs(ctx context.Context, tx *sqlx.Tx, tagIDs []int64) error {
+	if len(tagIDs) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In("SELECT COUNT(*) FROM tags WHERE id IN (?) AND deprecated_at = 0", tagIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var found int
+	if err := tx.GetContext(ctx, &found, tx.Rebind(query), args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+	uniqueTagIDs := slices.Clone(tagIDs)
+	slices.Sort(uniqueTagIDs)
+	uniqueTagIDs = slices.Compact(uniqueTagIDs)
+	if found != len(uniqueTagIDs) {
+		return echo.NewHTTPError(http.StatusBadRequest, "tags contain an unknown or deprecated tag id")
+	}
+	return nil
+}
+
+// cacheLivestreamTags は livestreamTags: のリストをtagIDsで置き換える。
+// 予約時と同じくLPUSHで積むので、並びはtagIDsの逆順になる
+func cacheLivestreamTags(ctx context.Context, livestreamID int64, tagIDs []int64) error {
+	key := fmt.Sprintf("%s%d", LivestreamTagsCacheRedisKeyPrefix, livestreamID)
+	cacheValues := make([]interface{}, len(tagIDs))
+	for i, tagID := range tagIDs {
+		cacheValues[i] = strconv.FormatInt(tagID, 10)
+	}
+
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		if len(cacheValues) > 0 {
+			pipe.LPush(ctx, key, cacheValues...)
+		}
+		return nil
+	})
+	return err
+}
+
 func getLivecommentReportsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -524,7 +964,11 @@ func getLivecommentReportsHandler(c echo.Context) error {
 	// existence already check
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	if livestreamModel.UserID != userID {
+	isHost, err := isLivestreamHost(ctx, tx, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream collaborators: "+err.Error())
+	}
+	if !isHost {
 		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
 	}
 
@@ -562,11 +1006,49 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 		return Livestream{}, err
 	}
 
-	tagIDs, err := redisClient.LRange(ctx, fmt.Sprintf("%s%d", LivestreamTagsCacheRedisKeyPrefix, livestreamModel.ID), 0, -1).Result()
+	var collaboratorModels []*UserModel
+	if err := tx.SelectContext(ctx, &collaboratorModels, "SELECT u.* FROM livestream_collaborators lc INNER JOIN users u ON u.id = lc.user_id WHERE lc.livestream_id = ? ORDER BY lc.created_at, lc.user_id", livestreamModel.ID); err != nil {
+		return Livestream{}, err
+	}
+	collaborators := make([]User, len(collaboratorModels))
+	for i := range collaboratorModels {
+		// FIXME: N+1
+		collaborator, err := fillUserResponse(ctx, tx, *collaboratorModels[i])
+		if err != nil {
+			return Livestream{}, err
+		}
+		collaborators[i] = collaborator
+	}
+
+	tags, err := getLivestreamTags(ctx, livestreamModel.ID)
 	if err != nil {
 		return Livestream{}, err
 	}
 
+	livestream := Livestream{
+		ID:            livestreamModel.ID,
+		Owner:         owner,
+		Collaborators: collaborators,
+		Title:         livestreamModel.Title,
+		Tags:          tags,
+		Description:   livestreamModel.Description,
+		PlaylistUrl:   livestreamModel.PlaylistUrl,
+		ThumbnailUrl:  livestreamModel.ThumbnailUrl,
+		StartAt:       livestreamModel.StartAt,
+		EndAt:         livestreamModel.EndAt,
+		Status:        livestreamModel.Status(time.Now().Unix()),
+		SeriesID:      livestreamModel.SeriesID,
+	}
+	return livestream, nil
+}
+
+// getLivestreamTags は配信のタグを livestreamTags: と tag_id2name: のキャッシュから引く
+func getLivestreamTags(ctx context.Context, livestreamID int64) ([]Tag, error) {
+	tagIDs, err := redisClient.LRange(ctx, fmt.Sprintf("%s%d", LivestreamTagsCacheRedisKeyPrefix, livestreamID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
 	cacheKeys := make([]string, len(tagIDs))
 	for i, tagID := range tagIDs {
 		cacheKeys[i] = TagID2NameCacheRedisKeyPrefix + tagID
@@ -576,7 +1058,7 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 	if len(cacheKeys) > 0 {
 		tagNames, err := redisClient.MGet(ctx, cacheKeys...).Result()
 		if err != nil {
-			return Livestream{}, err
+			return nil, err
 		}
 
 		for i, tagName := range tagNames {
@@ -587,17 +1069,5 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 			}
 		}
 	}
-
-	livestream := Livestream{
-		ID:           livestreamModel.ID,
-		Owner:        owner,
-		Title:        livestreamModel.Title,
-		Tags:         tags,
-		Description:  livestreamModel.Description,
-		PlaylistUrl:  livestreamModel.PlaylistUrl,
-		ThumbnailUrl: livestreamModel.ThumbnailUrl,
-		StartAt:      livestreamModel.StartAt,
-		EndAt:        livestreamModel.EndAt,
-	}
-	return livestream, nil
+	return tags, nil
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLivestreamModelStatus(t *testing.T) {
+	livestream := LivestreamModel{StartAt: 1000, EndAt: 2000}
+	cancelled := LivestreamModel{StartAt: 1000, EndAt: 2000, CancelledAt: 500}
+
+	tests := []struct {
+		name       string
+		livestream LivestreamModel
+		now        int64
+		want       string
+	}{
+		{"before start", livestream, 999, livestreamStatusScheduled},
+		{"at start", livestream, 1000, livestreamStatusLive},
+		{"just before end", livestream, 1999, livestreamStatusLive},
+		{"at end", livestream, 2000, livestreamStatusEnded},
+		{"after end", livestream, 3000, livestreamStatusEnded},
+		{"cancelled before start", cancelled, 999, livestreamStatusCancelled},
+		{"cancelled during the window", cancelled, 1500, livestreamStatusCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.livestream.Status(tt.now); got != tt.want {
+				t.Errorf("Status(%d) = %s, want %s", tt.now, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLivestreamModelAcceptsActivity(t *testing.T) {
+	prev := livestreamGracePeriod
+	livestreamGracePeriod = 300
+	t.Cleanup(func() {
+		livestreamGracePeriod = prev
+	})
+
+	livestream := LivestreamModel{StartAt: 1000, EndAt: 2000}
+	cancelled := LivestreamModel{StartAt: 1000, EndAt: 2000, CancelledAt: 500}
+
+	tests := []struct {
+		name       string
+		livestream LivestreamModel
+		now        int64
+		want       bool
+	}{
+		{"before the grace period", livestream, 699, false},
+		{"start of the grace period", livestream, 700, true},
+		{"live", livestream, 1500, true},
+		{"end of the grace period", livestream, 2299, true},
+		{"after the grace period", livestream, 2300, false},
+		{"cancelled", cancelled, 1500, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.livestream.AcceptsActivity(tt.now); got != tt.want {
+				t.Errorf("AcceptsActivity(%d) = %v, want %v", tt.now, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLivestreamStatusCondition(t *testing.T) {
+	const now = 1500
+
+	tests := []struct {
+		status   string
+		wantCond string
+		wantArgs []interface{}
+	}{
+		{livestreamStatusScheduled, "l.cancelled_at = 0 AND l.start_at > ?", []interface{}{int64(now)}},
+		{livestreamStatusLive, "l.cancelled_at = 0 AND l.start_at <= ? AND l.end_at > ?", []interface{}{int64(now), int64(now)}},
+		{livestreamStatusEnded, "l.cancelled_at = 0 AND l.end_at <= ?", []interface{}{int64(now)}},
+		{livestreamStatusCancelled, "l.cancelled_at > 0", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			cond, args, err := livestreamStatusCondition(tt.status, now, "l")
+			if err != nil {
+				t.Fatalf("livestreamStatusCondition: %v", err)
+			}
+			if cond != tt.wantCond {
+				t.Errorf("cond = %q, want %q", cond, tt.wantCond)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+
+	if _, _, err := livestreamStatusCondition("paused", now, "l"); err == nil {
+		t.Error("livestreamStatusCondition accepted an unknown status")
+	}
+}
+
+// 検索の絞り込みと配信ごとの状態が食い違わないこと
+func TestLivestreamStatusConditionMatchesStatus(t *testing.T) {
+	const now = 1500
+
+	livestreams := []LivestreamModel{
+		{StartAt: 1000, EndAt: 2000},
+		{StartAt: 1500, EndAt: 2000},
+		{StartAt: 1501, EndAt: 2000},
+		{StartAt: 1000, EndAt: 1500},
+		{StartAt: 1000, EndAt: 1501},
+		{StartAt: 1000, EndAt: 2000, CancelledAt: 900},
+	}
+	// livestreamStatusCondition が返す条件をGoで書いたもの
+	matches := map[string]func(l LivestreamModel) bool{
+		livestreamStatusScheduled: func(l LivestreamModel) bool { return l.CancelledAt == 0 && l.StartAt > now },
+		livestreamStatusLive:      func(l LivestreamModel) bool { return l.CancelledAt == 0 && l.StartAt <= now && l.EndAt > now },
+		livestreamStatusEnded:     func(l LivestreamModel) bool { return l.CancelledAt == 0 && l.EndAt <= now },
+		livestreamStatusCancelled: func(l LivestreamModel) bool { return l.CancelledAt > 0 },
+	}
+	for _, l := range livestreams {
+		status := l.Status(now)
+		for s, match := range matches {
+			if match(l) != (s == status) {
+				t.Errorf("%+v: Status = %s, but the %s condition matches = %v", l, status, s, match(l))
+			}
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 繰り返し予約の頻度
+const (
+	recurrenceFrequencyDaily  = "daily"
+	recurrenceFrequencyWeekly = "weekly"
+)
+
+// 一度の繰り返し予約で作れる配信の上限
+const maxRecurrenceOccurrences = 52
+
+type ReservationRecurrence struct {
+	// daily または weekly
+	Frequency string `json:"frequency"`
+	// 初回を含めた回数。untilとどちらかを指定する
+	Count int `json:"count"`
+	// この時刻までに開始する回を予約する
+	Until int64 `json:"until"`
+}
+
+type LivestreamSeriesModel struct {
+	ID        int64 `db:"id"`
+	UserID    int64 `db:"user_id"`
+	CreatedAt int64 `db:"created_at"`
+}
+
+type LivestreamSeries struct {
+	ID          int64        `json:"id"`
+	Livestreams []Livestream `json:"livestreams"`
+	CreatedAt   int64        `json:"created_at"`
+}
+
+// occurrences は繰り返しルールに従って各回の開始・終了時刻を列挙する
+func (r ReservationRecurrence) occurrences(startAt, endAt int64) ([][2]int64, error) {
+	var interval int64
+	switch r.Frequency {
+	case recurrenceFrequencyDaily:
+		interval = 24 * 60 * 60
+	case recurrenceFrequencyWeekly:
+		interval = 7 * 24 * 60 * 60
+	default:
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "recurrence frequency must be daily or weekly")
+	}
+
+	if r.Count == 0 && r.Until == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "recurrence requires count or until")
+	}
+	if r.Count < 0 || r.Count > maxRecurrenceOccurrences {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "recurrence count must be between 1 and "+strconv.Itoa(maxRecurrenceOccurrences))
+	}
+	if r.Until != 0 && r.Until < startAt {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "recurrence until must be after start_at")
+	}
+
+	var occurrences [][2]int64
+	for i := int64(0); ; i++ {
+		s := startAt + i*interval
+		if r.Count > 0 && len(occurrences) >= r.Count {
+			break
+		}
+		if r.Until != 0 && s > r.Until {
+			break
+		}
+		if len(occurrences) >= maxRecurrenceOccurrences {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "recurrence must not exceed "+strconv.Itoa(maxRecurrenceOccurrences)+" occurrences")
+		}
+		occurrences = append(occurrences, [2]int64{s, endAt + i*interval})
+	}
+	return occurrences, nil
+}
+
+// reserveLivestreamSeries は繰り返し予約のすべての回を同じトランザクションで予約する。
+// どれか1回でも予約できなければ全体を取り消す
+func reserveLivestreamSeries(c echo.Context, tx *sqlx.Tx, userID int64, req *ReserveLivestreamRequest) error {
+	ctx := c.Request().Context()
+
+	occurrences, err := req.Recurrence.occurrences(req.StartAt, req.EndAt)
+	if err != nil {
+		return err
+	}
+
+	seriesModel := LivestreamSeriesModel{
+		UserID:    userID,
+		CreatedAt: time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_series (user_id, created_at) VALUES (:user_id, :created_at)", seriesModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream series: "+err.Error())
+	}
+	seriesID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream series id: "+err.Error())
+	}
+	seriesModel.ID = seriesID
+
+	livestreamModels := make([]*LivestreamModel, len(occurrences))
+	for i, occurrence := range occurrences {
+		livestreamModel, err := reserveLivestream(ctx, tx, userID, req, occurrence[0], occurrence[1], seriesID)
+		if err != nil {
+			// echo.NewHTTPErrorが返っているのでそのまま出力
+			return err
+		}
+		livestreamModels[i] = livestreamModel
+	}
+
+	series, err := fillLivestreamSeriesResponse(c, tx, seriesModel, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream series: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	for i, livestreamModel := range livestreamModels {
+		if err := cacheReservedLivestream(ctx, livestreamModel, req.Tags, &series.Livestreams[i]); err != nil {
+			return err
+		}
+	}
+
+	// 繰り返し予約は初回の配信についてだけ通知する
+	// 予約はコミット済みなので、通知を積めなくても予約は成功として返す
+	if err := enqueueNotifications(ctx, notificationTypeReserved, livestreamModels[0]); err != nil {
+		log.Printf("failed to enqueue notifications for livestream %d: %+v", livestreamModels[0].ID, err)
+	}
+
+	for i := range series.Livestreams {
+		if err := enqueueWebhookEvent(ctx, userID, webhookEventLivestreamReserved, series.Livestreams[i]); err != nil {
+			log.Printf("failed to enqueue %s webhook for livestream %d: %+v", webhookEventLivestreamReserved, series.Livestreams[i].ID, err)
+		}
+	}
+
+	return c.JSON(http.StatusCreated, series)
+}
+
+// 繰り返し予約の取得
+// GET /api/livestream/series/:series_id
+func getLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	seriesID, err := strconv.ParseInt(c.Param("series_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil) // FIXME: selectのみのtxn
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var seriesModel LivestreamSeriesModel
+	if err := tx.GetContext(ctx, &seriesModel, "SELECT * FROM livestream_series WHERE id = ?", seriesID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream series not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream series: "+err.Error())
+	}
+
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE series_id = ? ORDER BY start_at", seriesID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	series, err := fillLivestreamSeriesResponse(c, tx, seriesModel, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream series: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, series)
+}
+
+// 繰り返し予約の一括キャンセル。開始済みの回はそのまま残す
+// DELETE /api/livestream/series/:series_id
+func cancelLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	seriesID, err := strconv.ParseInt(c.Param("series_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var seriesModel LivestreamSeriesModel
+	if err := tx.GetContext(ctx, &seriesModel, "SELECT * FROM livestream_series WHERE id = ?", seriesID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream series not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream series: "+err.Error())
+	}
+	if seriesModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't cancel other streamer's livestream series")
+	}
+
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE series_id = ? ORDER BY start_at FOR UPDATE", seriesID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	now := time.Now().Unix()
+	for _, livestreamModel := range livestreamModels {
+		if livestreamModel.Status(now) != livestreamStatusScheduled {
+			continue
+		}
+		if err := cancelLivestream(ctx, tx, livestreamModel); err != nil {
+			return err
+		}
+	}
+
+	series, err := fillLivestreamSeriesResponse(c, tx, seriesModel, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream series: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, series)
+}
+
+func fillLivestreamSeriesResponse(c echo.Context, tx *sqlx.Tx, seriesModel LivestreamSeriesModel, livestreamModels []*LivestreamModel) (LivestreamSeries, error) {
+	ctx := c.Request().Context()
+
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i := range livestreamModels {
+		// FIXME: 3N+1
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+		if err != nil {
+			return LivestreamSeries{}, err
+		}
+		livestreams[i] = livestream
+	}
+
+	return LivestreamSeries{
+		ID:          seriesModel.ID,
+		Livestreams: livestreams,
+		CreatedAt:   seriesModel.CreatedAt,
+	}, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ユーザ名をappendして使うこと
+const loginFailureUserRedisKeyPrefix = "login_failures:user:"
+
+// IPアドレスをappendして使うこと
+const loginFailureIPRedisKeyPrefix = "login_failures:ip:"
+
+// login_failures:*のキーをappendして使うこと。TTLが残っている間はログインを受け付けない
+const loginBlockedRedisKeyPrefix = "login_blocked:"
+
+// loginThrottlePolicy はログイン失敗回数に応じた待ち時間の決め方
+type loginThrottlePolicy struct {
+	// この回数までの失敗は待たせない
+	freeAttempts int64
+	// この回数失敗したらlockoutの間ロックする
+	lockoutAttempts int64
+	lockout         time.Duration
+	// 失敗回数を数える期間。最後の失敗からこの期間が経てば回数は忘れる
+	window time.Duration
+}
+
+var (
+	// ユーザ単位では少ない回数でロックする
+	loginThrottleUserPolicy = loginThrottlePolicy{
+		freeAttempts:    3,
+		lockoutAttempts: 10,
+		lockout:         15 * time.Minute,
+		window:          15 * time.Minute,
+	}
+	// NATの内側に複数ユーザがいることがあるのでIP単位は緩めにする
+	loginThrottleIPPolicy = loginThrottlePolicy{
+		freeAttempts:    20,
+		lockoutAttempts: 100,
+		lockout:         15 * time.Minute,
+		window:          15 * time.Minute,
+	}
+)
+
+// 段階的な待ち時間の上限
+const loginMaxDelay = 60 * time.Second
+
+// loginAttemptScript はログインの試行をひとまず失敗として数え、回数に応じた待ち時間を設定する。
+// 同時に来た試行がどれも数える前の回数を見て通り抜けないよう、確認と加算をまとめて行う。
+// KEYSは失敗回数のキーとそのlogin_blocked:のキーを交互に並べたもの、
+// ARGVはそれぞれの loginThrottlePolicy の freeAttempts, lockoutAttempts, lockout, window (ミリ秒) と、最後に loginMaxDelay (ミリ秒)。
+// 待たせている間なら数えずに {0, 残りミリ秒} を、通したら {1, 失敗に終わったときの待ちミリ秒} を返す
+var loginAttemptScript = redis.NewScript(`
+local maxDelay = tonumber(ARGV[#ARGV])
+local blocked = 0
+for i = 2, #KEYS, 2 do
+  local ttl = redis.call('PTTL', KEYS[i])
+  if ttl > blocked then
+    blocked = ttl
+  end
+end
+if blocked > 0 then
+  return {0, blocked}
+end
+
+local retryAfter = 0
+for i = 1, #KEYS, 2 do
+  local base = (i - 1) * 2
+  local freeAttempts = tonumber(ARGV[base + 1])
+  local lockoutAttempts = tonumber(ARGV[base + 2])
+  local lockout = tonumber(ARGV[base + 3])
+  local window = tonumber(ARGV[base + 4])
+
+  local failures = redis.call('INCR', KEYS[i])
+  redis.call('PEXPIRE', KEYS[i], window)
+
+  -- 1秒, 2秒, 4秒, ... と倍にしていく
+  local delay = 0
+  if failures >= lockoutAttempts then
+    delay = lockout
+  elseif failures > freeAttempts then
+    delay = math.min(1000 * 2 ^ (failures - freeAttempts - 1), maxDelay)
+  end
+  if delay > 0 then
+    redis.call('SET', KEYS[i + 1], failures, 'PX', math.floor(delay))
+    if delay > retryAfter then
+      retryAfter = delay
+    end
+  end
+end
+return {1, math.floor(retryAfter)}
+`)
+
+// loginSucceededScript は先に失敗として数えた試行を取り消す。
+// ユーザ単位の回数は忘れ、IP単位の回数は他のユーザへの攻撃も含むのでこの試行の分だけ戻す。
+// KEYSはユーザの失敗回数のキー、そのlogin_blocked:のキー、IPアドレスの失敗回数のキー
+var loginSucceededScript = redis.NewScript(`
+redis.call('DEL', KEYS[1], KEYS[2])
+local failures = tonumber(redis.call('GET', KEYS[3]) or '0')
+if failures > 0 then
+  redis.call('DECR', KEYS[3])
+end
+return 0
+`)
+
+// beginLoginAttempt はパスワードを確かめる前に試行を失敗として数える。
+// 失敗が続いていて待たせている間ならallowedはfalseで、retryAfterは試せるようになるまでの時間。
+// allowedがtrueなら、retryAfterはこの試行が失敗に終わったときに次に試せるようになるまでの時間。
+// パスワードが合っていたら loginSucceeded で取り消すこと
+func beginLoginAttempt(ctx context.Context, username, ip string) (allowed bool, retryAfter time.Duration, err error) {
+	failureKeys := []string{
+		loginFailureUserRedisKeyPrefix + username,
+		loginFailureIPRedisKeyPrefix + ip,
+	}
+	policies := []loginThrottlePolicy{loginThrottleUserPolicy, loginThrottleIPPolicy}
+
+	keys := make([]string, 0, len(failureKeys)*2)
+	args := make([]interface{}, 0, len(policies)*4+1)
+	for i, key := range failureKeys {
+		keys = append(keys, key, loginBlockedRedisKeyPrefix+key)
+		args = append(args,
+			policies[i].freeAttempts,
+			policies[i].lockoutAttempts,
+			policies[i].lockout.Milliseconds(),
+			policies[i].window.Milliseconds(),
+		)
+	}
+	args = append(args, loginMaxDelay.Milliseconds())
+
+	res, err := loginAttemptScript.Run(ctx, redisClient, keys, args...).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+// loginSucceeded はパスワードが合っていた試行を失敗の回数から取り消す
+func loginSucceeded(ctx context.Context, username, ip string) error {
+	userKey := loginFailureUserRedisKeyPrefix + username
+	keys := []string{userKey, loginBlockedRedisKeyPrefix + userKey, loginFailureIPRedisKeyPrefix + ip}
+	return loginSucceededScript.Run(ctx, redisClient, keys).Err()
+}
+
+// retryAfterSeconds はRetry-Afterヘッダに入れる秒数 (切り上げ)
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
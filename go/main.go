@@ -12,6 +12,7 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
 	"log"
 	"net"
 	"net/http"
@@ -19,17 +20,26 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 )
 
 const (
 	listenPort                     = 8080
 	powerDNSSubdomainAddressEnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"
+	livestreamGracePeriodEnvKey    = "ISUCON13_LIVESTREAM_GRACE_PERIOD_SECONDS"
+	adminUsernamesEnvKey           = "ISUCON13_ADMIN_USERNAMES"
+	bcryptCostEnvKey               = "ISUCON13_BCRYPT_COST"
+	accountPurgeGracePeriodEnvKey  = "ISUCON13_ACCOUNT_PURGE_GRACE_PERIOD_SECONDS"
 )
 
 var (
 	powerDNSSubdomainAddress string
 	dbConn                   *sqlx.DB
 	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
+	// 配信の開始前・終了後にライブコメントやリアクションを受け付ける猶予
+	livestreamGracePeriod int64 = 5 * 60
+	// 予約受付期間やタグを管理できるユーザ
+	adminUsernames = map[string]bool{}
 )
 
 func init() {
@@ -37,6 +47,41 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	if v, ok := os.LookupEnv(livestreamGracePeriodEnvKey); ok {
+		gracePeriod, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || gracePeriod < 0 {
+			log.Fatalf("failed to parse environment variable '%s' as non-negative seconds: %+v", livestreamGracePeriodEnvKey, err)
+		}
+		livestreamGracePeriod = gracePeriod
+	}
+	if v, ok := os.LookupEnv(accountPurgeGracePeriodEnvKey); ok {
+		gracePeriod, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || gracePeriod < 0 {
+			log.Fatalf("failed to parse environment variable '%s' as non-negative seconds: %+v", accountPurgeGracePeriodEnvKey, err)
+		}
+		accountPurgeGracePeriod = gracePeriod
+	}
+	if v, ok := os.LookupEnv(iconStoreEnvKey); ok {
+		store, err := newIconStoreFromEnv(v)
+		if err != nil {
+			log.Fatalf("failed to configure icon store from environment variable '%s': %+v", iconStoreEnvKey, err)
+		}
+		iconStore = store
+	}
+	if v, ok := os.LookupEnv(bcryptCostEnvKey); ok {
+		cost, err := strconv.Atoi(v)
+		if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			log.Fatalf("failed to parse environment variable '%s' as bcrypt cost (%d-%d): %+v", bcryptCostEnvKey, bcrypt.MinCost, bcrypt.MaxCost, err)
+		}
+		bcryptCost = cost
+	}
+	if v, ok := os.LookupEnv(adminUsernamesEnvKey); ok {
+		for _, username := range strings.Split(v, ",") {
+			if username = strings.TrimSpace(username); username != "" {
+				adminUsernames[username] = true
+			}
+		}
+	}
 }
 
 type InitializeResponse struct {
@@ -124,6 +169,9 @@ func initializeHandler(c echo.Context) error {
 	cacheReactionsOnInit()
 	cacheSpamCountOnInit()
 	cacheLeaderBoardOnInit()
+	cacheFollowCountsOnInit()
+
+	// 初期データのアイコンは importLegacyIconOnce で最初に引かれたときに取り込む
 
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
@@ -136,36 +184,9 @@ const TagID2NameCacheRedisKeyPrefix = "tag_id2name:"
 const Name2TagIDCacheRedisKeyPrefix = "name2tag_id:"
 
 func cacheTagsOnInit() {
-	var tagModels []*TagModel
-	err := dbConn.Select(&tagModels, "SELECT * FROM tags")
-	if err != nil {
-		log.Fatalf("failed to cache the tags: %s", err)
+	if err := refreshTagsCache(context.Background(), dbConn, nil, nil); err != nil {
+		log.Fatalf("failed to make cache for tags: %s", err)
 	}
-
-	tagsCacheItems := make([]interface{}, 0, len(tagModels))
-	tagID2NameCacheItems := make([]interface{}, len(tagModels)*2)
-	name2tagIDCacheItems := make([]interface{}, len(tagModels)*2)
-	i := 0
-	for _, tag := range tagModels {
-		tagID2NameCacheItems[i] = fmt.Sprintf("%s%d", TagID2NameCacheRedisKeyPrefix, tag.ID)
-		name2tagIDCacheItems[i] = Name2TagIDCacheRedisKeyPrefix + tag.Name
-		i++
-		tagID2NameCacheItems[i] = tag.Name
-		name2tagIDCacheItems[i] = strconv.FormatInt(tag.ID, 10)
-		i++
-
-		tagsCacheItems = append(tagsCacheItems, fmt.Sprintf("%d:%s", tag.ID, tag.Name))
-	}
-	err = redisClient.MSet(context.Background(), tagID2NameCacheItems...).Err()
-	if err != nil {
-		log.Fatalf("failed to make cache for tags: %w", err)
-	}
-	err = redisClient.MSet(context.Background(), name2tagIDCacheItems...).Err()
-	if err != nil {
-		log.Fatalf("failed to make cache for tags: %w", err)
-	}
-
-	redisClient.LPush(context.Background(), tagsCacheRedisKey, tagsCacheItems...)
 }
 
 func cacheLivestreamTagsOnInit() {
@@ -251,6 +272,9 @@ func cacheLivestreamViewersHistoryOnInit() {
 const livestreamReactionsCachePrefix = "num_reactions:livestream:"
 const userReactionsCachePrefix = "num_reactions:user:"
 
+// 配信IDをappendして使うこと。ユーザリーダーボードをホストに割り振るための配信ごとのチップ合計
+const livestreamTipsCachePrefix = "num_tips:livestream:"
+
 func cacheReactionsOnInit() {
 	var reactions []*ReactionModel
 	err := dbConn.Select(&reactions, "SELECT * FROM reactions")
@@ -296,7 +320,7 @@ const UserLeaderBoardRedisKey = "user_leader_board"
 
 func cacheLeaderBoardOnInit() {
 	var users []*UserModel
-	err := dbConn.Select(&users, "SELECT * FROM users")
+	err := dbConn.Select(&users, "SELECT * FROM users WHERE deleted_at = 0")
 	if err != nil {
 		log.Fatalf("failed to cache the user leader board: %s", err)
 	}
@@ -329,38 +353,105 @@ func cacheLeaderBoardOnInit() {
 		}
 	}
 
+	var collaborators []*LivestreamCollaboratorModel
+	err = dbConn.Select(&collaborators, "SELECT * FROM livestream_collaborators ORDER BY created_at, user_id")
+	if err != nil {
+		log.Fatalf("failed to cache the leader board: %s", err)
+	}
+	livestreamID2CollaboratorIDs := make(map[int64][]int64)
+	for _, collaborator := range collaborators {
+		livestreamID2CollaboratorIDs[collaborator.LivestreamID] = append(livestreamID2CollaboratorIDs[collaborator.LivestreamID], collaborator.UserID)
+	}
+	livestreamID2Reactions := make(map[int64]int64)
 	var reactions []*ReactionModel
 	err = dbConn.Select(&reactions, "SELECT * FROM reactions")
 	if err != nil {
 		log.Fatalf("failed to cache the leader board: %s", err)
 	}
 	for _, reaction := range reactions {
-		err = redisClient.ZIncrBy(context.Background(), UserLeaderBoardRedisKey, 1, strconv.FormatInt(livestreamID2UserID[reaction.LivestreamID], 10)).Err()
-		if err != nil {
-			log.Fatalf("failed to cache the leader board: %s", err)
-		}
+		livestreamID2Reactions[reaction.LivestreamID]++
 		err = redisClient.ZIncrBy(context.Background(), LivestreamLeaderBoardRedisKey, 1, strconv.FormatInt(reaction.LivestreamID, 10)).Err()
 		if err != nil {
 			log.Fatalf("failed to cache the leader board: %s", err)
 		}
 	}
 
+	livestreamID2Tips := make(map[int64]int64)
 	var comments []*LivecommentModel
 	err = dbConn.Select(&comments, "SELECT * FROM livecomments WHERE tip > 0")
 	if err != nil {
 		log.Fatalf("failed to cache the leader board: %s", err)
 	}
 	for _, comment := range comments {
-		err = redisClient.ZIncrBy(context.Background(), UserLeaderBoardRedisKey, float64(comment.Tip), strconv.FormatInt(livestreamID2UserID[comment.LivestreamID], 10)).Err()
+		livestreamID2Tips[comment.LivestreamID] += comment.Tip
+		err = redisClient.ZIncrBy(context.Background(), LivestreamLeaderBoardRedisKey, float64(comment.Tip), strconv.FormatInt(comment.LivestreamID, 10)).Err()
 		if err != nil {
 			log.Fatalf("failed to cache the leader board: %s", err)
 		}
+	}
 
-		err = redisClient.ZIncrBy(context.Background(), LivestreamLeaderBoardRedisKey, float64(comment.Tip), strconv.FormatInt(comment.LivestreamID, 10)).Err()
+	// incrUserLeaderBoardForHosts と同じく、配信ごとの合計をホスト全員に割り振って加算する
+	for livestreamID, userID := range livestreamID2UserID {
+		collaboratorIDs := livestreamID2CollaboratorIDs[livestreamID]
+		err = incrUserLeaderBoardForHostIDs(context.Background(), userID, collaboratorIDs, 0, livestreamID2Reactions[livestreamID])
+		if err != nil {
+			log.Fatalf("failed to cache the leader board: %s", err)
+		}
+		err = incrUserLeaderBoardForHostIDs(context.Background(), userID, collaboratorIDs, 0, livestreamID2Tips[livestreamID])
+		if err != nil {
+			log.Fatalf("failed to cache the leader board: %s", err)
+		}
+		err = redisClient.Set(context.Background(), fmt.Sprintf("%s%d", livestreamTipsCachePrefix, livestreamID), strconv.FormatInt(livestreamID2Tips[livestreamID], 10), 0).Err()
 		if err != nil {
 			log.Fatalf("failed to cache the leader board: %s", err)
 		}
 	}
+
+	// 退会したユーザの過去の配信への加算で入ってしまうので除く
+	var deletedUserIDs []int64
+	err = dbConn.Select(&deletedUserIDs, "SELECT id FROM users WHERE deleted_at > 0")
+	if err != nil {
+		log.Fatalf("failed to cache the user leader board: %s", err)
+	}
+	for _, userID := range deletedUserIDs {
+		err = redisClient.ZRem(context.Background(), UserLeaderBoardRedisKey, strconv.FormatInt(userID, 10)).Err()
+		if err != nil {
+			log.Fatalf("failed to cache the user leader board: %s", err)
+		}
+	}
+}
+
+// ユーザIDをappendして使うこと
+const followerCountCachePrefix = "num_followers:user:"
+const followingCountCachePrefix = "num_following:user:"
+
+func cacheFollowCountsOnInit() {
+	var counts []struct {
+		UserID int64 `db:"user_id"`
+		Count  int64 `db:"count"`
+	}
+	err := dbConn.Select(&counts, "SELECT followee_id AS user_id, COUNT(*) AS count FROM follows GROUP BY followee_id")
+	if err != nil {
+		log.Fatalf("failed to cache the follower counts: %s", err)
+	}
+	for _, count := range counts {
+		err := redisClient.Set(context.Background(), fmt.Sprintf("%s%d", followerCountCachePrefix, count.UserID), count.Count, 0).Err()
+		if err != nil {
+			log.Fatalf("failed to cache the follower counts: %s", err)
+		}
+	}
+
+	counts = nil
+	err = dbConn.Select(&counts, "SELECT follower_id AS user_id, COUNT(*) AS count FROM follows GROUP BY follower_id")
+	if err != nil {
+		log.Fatalf("failed to cache the following counts: %s", err)
+	}
+	for _, count := range counts {
+		err := redisClient.Set(context.Background(), fmt.Sprintf("%s%d", followingCountCachePrefix, count.UserID), count.Count, 0).Err()
+		if err != nil {
+			log.Fatalf("failed to cache the following counts: %s", err)
+		}
+	}
 }
 
 const livestreamID2UserIDCachePrefix = "livestream2user:"
@@ -400,10 +491,14 @@ func main() {
 	e := echo.New()
 	// e.Debug = true
 	// e.Logger.SetLevel(echolog.DEBUG)
+	// クライアントのIPアドレスは同じホストのnginxが付けたX-Real-IPからだけ読む。
+	// それ以外から届いたX-Real-IP・X-Forwarded-Forは詐称できるので無視して接続元を使う
+	e.IPExtractor = echo.ExtractIPFromRealIPHeader(echo.TrustLinkLocal(false), echo.TrustPrivateNet(false))
 	e.Use(middleware.Logger())
 	cookieStore := sessions.NewCookieStore(secret)
 	cookieStore.Options.Domain = "*.u.isucon.dev"
 	e.Use(session.Middleware(cookieStore))
+	e.Use(apiTokenMiddleware)
 	// e.Use(middleware.Recover())
 
 	// 初期化
@@ -416,18 +511,64 @@ func main() {
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	// cancel or reschedule reservation
+	e.DELETE("/api/livestream/:livestream_id/reservation", cancelReservationHandler)
+	e.PATCH("/api/livestream/:livestream_id/reservation", updateReservationHandler)
+	// recurring reservation
+	e.GET("/api/livestream/series/:series_id", getLivestreamSeriesHandler)
+	e.DELETE("/api/livestream/series/:series_id", cancelLivestreamSeriesHandler)
+	// 予約枠の空き状況
+	e.GET("/api/reservation_slots", getReservationSlotsHandler)
+	e.GET("/api/reservation_slots/next_free", getNextFreeReservationWindowHandler)
+
+	// admin
+	// 予約受付期間とメンテナンス期間
+	e.GET("/api/admin/reservation_terms", getReservationTermsHandler)
+	e.POST("/api/admin/reservation_terms", postReservationTermHandler)
+	e.POST("/api/admin/reservation_terms/:term_id/extend", extendReservationTermHandler)
+	e.GET("/api/admin/reservation_blackouts", getReservationBlackoutsHandler)
+	e.POST("/api/admin/reservation_blackouts", postReservationBlackoutHandler)
+	e.DELETE("/api/admin/reservation_blackouts/:blackout_id", deleteReservationBlackoutHandler)
+	e.GET("/api/admin/tags", getAdminTagsHandler)
+	e.POST("/api/admin/tags", postTagHandler)
+	e.PATCH("/api/admin/tags/:tag_id", renameTagHandler)
+	e.POST("/api/admin/tags/:tag_id/merge", mergeTagHandler)
+	e.POST("/api/admin/tags/:tag_id/deprecate", deprecateTagHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
+	// follow
+	e.POST("/api/user/:username/follow", followUserHandler)
+	e.DELETE("/api/user/:username/follow", unfollowUserHandler)
+	e.GET("/api/feed", getFeedHandler)
+	// notification
+	e.PUT("/api/user/:username/follow/notification", enableFollowNotificationHandler)
+	e.DELETE("/api/user/:username/follow/notification", disableFollowNotificationHandler)
+	e.GET("/api/notifications", getNotificationsHandler)
+	e.POST("/api/notifications/read", readNotificationsHandler)
+	// 通知のストリーミング (SSE)
+	e.GET("/api/notifications/stream", getNotificationStreamHandler)
+	e.GET("/api/notifications/settings", getNotificationSettingsHandler)
+	e.PUT("/api/notifications/settings", putNotificationSettingsHandler)
+	// webhook
+	e.GET("/api/webhooks", getWebhooksHandler)
+	e.POST("/api/webhooks", postWebhookHandler)
+	e.DELETE("/api/webhooks/:webhook_id", deleteWebhookHandler)
+	e.GET("/api/webhooks/:webhook_id/deliveries", getWebhookDeliveriesHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	e.PATCH("/api/livestream/:livestream_id", updateLivestreamHandler)
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
+	// ライブコメントのストリーミング (SSE)
+	e.GET("/api/livestream/:livestream_id/livecomment/stream", getLivecommentStreamHandler)
 	// ライブコメント投稿
 	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
 	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
 	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
+	// リアクションの投稿と集約配信 (WebSocket)
+	e.GET("/api/livestream/:livestream_id/reaction/ws", reactionWebSocketHandler)
 
 	// (配信者向け)ライブコメントの報告一覧取得API
 	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
@@ -446,12 +587,26 @@ func main() {
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
+	e.POST("/api/logout", logoutHandler)
+	e.POST("/api/logout/all", logoutAllHandler)
+	e.GET("/api/user/me/sessions", getSessionsHandler)
+	e.DELETE("/api/user/me/sessions/:session_id", deleteSessionHandler)
+	e.GET("/api/user/me/tokens", getAPITokensHandler)
+	e.POST("/api/user/me/tokens", postAPITokenHandler)
+	e.DELETE("/api/user/me/tokens/:token_id", revokeAPITokenHandler)
 	e.GET("/api/user/me", getMeHandler)
+	e.PATCH("/api/user/me", patchMeHandler)
+	e.POST("/api/user/me/password", postPasswordHandler)
+	e.DELETE("/api/user/me", deleteMeHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
 	e.POST("/api/icon", postIconHandler)
+	e.GET("/api/icon/:hash", getIconByHashHandler)
+	e.GET("/api/user/me/icons", getIconHistoryHandler)
+	e.POST("/api/user/me/icons/:icon_id/select", selectIconHandler)
+	e.DELETE("/api/user/me/icons/:icon_id", deleteIconHandler)
 
 	// stats
 	// ライブ配信統計情報
@@ -477,6 +632,16 @@ func main() {
 		os.Exit(1)
 	}
 	powerDNSSubdomainAddress = subdomainAddr
+	dnsProvider = newDNSProviderFromEnv(os.Getenv(powerDNSAPIURLEnvKey), os.Getenv(powerDNSAPIKeyEnvKey), os.Getenv(powerDNSAPIServerIDEnvKey))
+	// サブドメインの追加をまとめて送る
+	go runDNSRecordBatcher(context.Background())
+
+	// 配信開始の通知
+	go runLiveNotificationScheduler(context.Background())
+	// Webhookの送信と再送
+	go runWebhookWorker(context.Background())
+	// 退会したユーザの個人データの削除
+	go runAccountPurgeWorker(context.Background())
 
 	// pprof、最後には消すこと
 	go func() {
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 通知の種類
+const (
+	// フォローしている配信者が配信を予約した
+	notificationTypeReserved = "livestream_reserved"
+	// フォローしている配信者の配信が始まった
+	notificationTypeLive = "livestream_live"
+)
+
+// ユーザIDをappendして使うこと
+const notificationChannelRedisKeyPrefix = "notification_channel:"
+
+// この間隔ごとに開始時刻を迎えた配信を探して通知する
+const liveNotificationScanInterval = 5 * time.Second
+
+// 開始からこの秒数を過ぎた配信は通知しない。起動直後に過去の配信をまとめて通知しないため
+const liveNotificationWindow = 5 * 60
+
+// SSEの再接続時に再送する通知の上限
+const notificationStreamBackfillLimit = 100
+
+type NotificationModel struct {
+	ID           int64  `db:"id"`
+	UserID       int64  `db:"user_id"`
+	Type         string `db:"type"`
+	LivestreamID int64  `db:"livestream_id"`
+	CreatedAt    int64  `db:"created_at"`
+	// 未読なら0
+	ReadAt int64 `db:"read_at"`
+}
+
+type Notification struct {
+	ID         int64      `json:"id"`
+	Type       string     `json:"type"`
+	Livestream Livestream `json:"livestream"`
+	Read       bool       `json:"read"`
+	CreatedAt  int64      `json:"created_at"`
+}
+
+type NotificationSettingsModel struct {
+	UserID int64 `db:"user_id"`
+	// この時刻まではすべての通知を止める。0なら止めない
+	MutedUntil       int64 `db:"muted_until"`
+	MuteReservations bool  `db:"mute_reservations"`
+	MuteLive         bool  `db:"mute_live"`
+}
+
+type NotificationSettings struct {
+	MutedUntil       int64 `json:"muted_until"`
+	MuteReservations bool  `json:"mute_reservations"`
+	MuteLive         bool  `json:"mute_live"`
+}
+
+type ReadNotificationsRequest struct {
+	// 空ならすべての通知を既読にする
+	NotificationIDs []int64 `json:"notification_ids"`
+}
+
+// 配信者の配信予約・配信開始の通知を受け取る
+// PUT /api/user/:username/follow/notification
+func enableFollowNotificationHandler(c echo.Context) error {
+	return setFollowNotification(c, true)
+}
+
+// 配信者の通知を受け取らない
+// DELETE /api/user/:username/follow/notification
+func disableFollowNotificationHandler(c echo.Context) error {
+	return setFollowNotification(c, false)
+}
+
+func setFollowNotification(c echo.Context, notify bool) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	followeeID, err := getUserIDByName(ctx, c.Param("username"))
+	if err != nil {
+		return err
+	}
+
+	var following bool
+	if err := dbConn.GetContext(ctx, &following, "SELECT EXISTS(SELECT 1 FROM follows WHERE follower_id = ? AND followee_id = ?)", userID, followeeID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get follow: "+err.Error())
+	}
+	if !following {
+		return echo.NewHTTPError(http.StatusBadRequest, "follow the user before turning on notifications")
+	}
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE follows SET notify = ? WHERE follower_id = ? AND followee_id = ?", notify, userID, followeeID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update follow: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// 通知一覧
+// GET /api/notifications?unread=true
+func getNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	page, err := parsePagination(c, 1)
+	if err != nil {
+		return err
+	}
+
+	query := "SELECT * FROM notifications WHERE user_id = ?"
+	if c.QueryParam("unread") == "true" {
+		query += " AND read_at = 0"
+	}
+	query, params := page.Apply(query, []interface{}{userID}, "id")
+
+	tx, err := dbConn.BeginTxx(ctx, nil) // FIXME: selectのみのtxn
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var notificationModels []NotificationModel
+	if err := tx.SelectContext(ctx, &notificationModels, query, params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notifications: "+err.Error())
+	}
+	if page.Forward() {
+		slices.Reverse(notificationModels)
+	}
+	var next pageCursor
+	if page.HasNext(len(notificationModels)) {
+		last := notificationModels[len(notificationModels)-1]
+		if page.Forward() {
+			last = notificationModels[0]
+		}
+		next = pageCursor{last.ID}
+	}
+
+	notifications := make([]Notification, len(notificationModels))
+	for i := range notificationModels {
+		// FIXME: N+1
+		notification, err := fillNotificationResponse(ctx, tx, notificationModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill notification: "+err.Error())
+		}
+		notifications[i] = notification
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, newPageResponse(notifications, next))
+}
+
+// 通知を既読にする
+// POST /api/notifications/read
+func readNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req ReadNotificationsRequest
+	if c.Request().ContentLength != 0 {
+		if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+		}
+	}
+
+	query := "UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at = 0"
+	args := []interface{}{time.Now().Unix(), userID}
+	if len(req.NotificationIDs) > 0 {
+		inQuery, inArgs, err := sqlx.In(" AND id IN (?)", req.NotificationIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		query += inQuery
+		args = append(args, inArgs...)
+	}
+	if _, err := dbConn.ExecContext(ctx, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update notifications: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// 通知のストリーミング (SSE)
+// GET /api/notifications/stream
+func getNotificationStreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var lastSentID int64
+	if v := lastEventID(c); v != "" {
+		var err error
+		lastSentID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || lastSentID < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Last-Event-ID must be a non-negative integer")
+		}
+	} else {
+		// 初回接続ではこれから届く通知だけを送る
+		if err := dbConn.GetContext(ctx, &lastSentID, "SELECT IFNULL(MAX(id), 0) FROM notifications WHERE user_id = ?", userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notifications: "+err.Error())
+		}
+	}
+
+	// 再送より先に購読しておかないと、再送中に届いた通知を取りこぼす
+	pubsub := redisClient.Subscribe(ctx, fmt.Sprintf("%s%d", notificationChannelRedisKeyPrefix, userID))
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to subscribe notifications: "+err.Error())
+	}
+
+	startSSE(c)
+
+	// 購読のメッセージには中身がなく、届いたらDBから未送信の通知を読み出す
+	sendNew := func() error {
+		notifications, err := getNotificationsAfter(ctx, userID, lastSentID)
+		if err != nil {
+			c.Logger().Warnf("failed to get notifications: %+v", err)
+			return nil
+		}
+		for _, notification := range notifications {
+			if err := writeSSEEvent(c, strconv.FormatInt(notification.ID, 10), "notification", notification); err != nil {
+				return err
+			}
+			lastSentID = notification.ID
+		}
+		return nil
+	}
+	if err := sendNew(); err != nil {
+		return nil
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			if err := writeSSEHeartbeat(c); err != nil {
+				return nil
+			}
+		case _, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := sendNew(); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+func getNotificationsAfter(ctx context.Context, userID int64, afterID int64) ([]Notification, error) {
+	tx, err := dbConn.BeginTxx(ctx, nil) // FIXME: selectのみtxn
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var notificationModels []NotificationModel
+	if err := tx.SelectContext(ctx, &notificationModels, "SELECT * FROM notifications WHERE user_id = ? AND id > ? ORDER BY id ASC LIMIT ?", userID, afterID, notificationStreamBackfillLimit); err != nil {
+		return nil, err
+	}
+
+	notifications := make([]Notification, len(notificationModels))
+	for i := range notificationModels {
+		// FIXME: N+1
+		notification, err := fillNotificationResponse(ctx, tx, notificationModels[i])
+		if err != nil {
+			return nil, err
+		}
+		notifications[i] = notification
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+// 通知の設定
+// GET /api/notifications/settings
+func getNotificationSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var settingsModel NotificationSettingsModel
+	if err := dbConn.GetContext(ctx, &settingsModel, "SELECT * FROM notification_settings WHERE user_id = ?", userID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notification settings: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, NotificationSettings{
+		MutedUntil:       settingsModel.MutedUntil,
+		MuteReservations: settingsModel.MuteReservations,
+		MuteLive:         settingsModel.MuteLive,
+	})
+}
+
+// 通知の設定の更新
+// PUT /api/notifications/settings
+func putNotificationSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	req := NotificationSettings{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.MutedUntil < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "muted_until must be unix time or 0")
+	}
+
+	settingsModel := NotificationSettingsModel{
+		UserID:           userID,
+		MutedUntil:       req.MutedUntil,
+		MuteReservations: req.MuteReservations,
+		MuteLive:         req.MuteLive,
+	}
+	query := `
+	INSERT INTO notification_settings (user_id, muted_until, mute_reservations, mute_live)
+	VALUES (:user_id, :muted_until, :mute_reservations, :mute_live)
+	ON DUPLICATE KEY UPDATE muted_until = VALUES(muted_until), mute_reservations = VALUES(mute_reservations), mute_live = VALUES(mute_live)`
+	if _, err := dbConn.NamedExecContext(ctx, query, settingsModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update notification settings: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, req)
+}
+
+// enqueueNotifications は配信者の通知を受け取る設定にしているフォロワーに通知を積み、
+// SSEで待っているクライアントに知らせる。ミュートしているユーザには積まない
+func enqueueNotifications(ctx context.Context, notificationType string, livestreamModel *LivestreamModel) error {
+	userIDs, err := insertNotifications(ctx, dbConn, notificationType, livestreamModel)
+	if err != nil {
+		return err
+	}
+	return publishNotifications(ctx, notificationType, userIDs)
+}
+
+// insertNotifications は通知を積み、積んだユーザのIDを返す
+func insertNotifications(ctx context.Context, db sqlx.ExtContext, notificationType string, livestreamModel *LivestreamModel) ([]int64, error) {
+	muteColumn := "mute_reservations"
+	if notificationType == notificationTypeLive {
+		muteColumn = "mute_live"
+	}
+
+	now := time.Now().Unix()
+	var userIDs []int64
+	query := fmt.Sprintf(`
+	SELECT f.follower_id FROM follows f
+	LEFT JOIN notification_settings s ON s.user_id = f.follower_id
+	WHERE f.followee_id = ? AND f.notify = 1 AND (s.user_id IS NULL OR (s.muted_until <= ? AND s.%s = 0))`, muteColumn)
+	if err := sqlx.SelectContext(ctx, db, &userIDs, query, livestreamModel.UserID, now); err != nil {
+		return nil, err
+	}
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	notificationModels := make([]NotificationModel, len(userIDs))
+	for i, userID := range userIDs {
+		notificationModels[i] = NotificationModel{
+			UserID:       userID,
+			Type:         notificationType,
+			LivestreamID: livestreamModel.ID,
+			CreatedAt:    now,
+		}
+	}
+	if _, err := sqlx.NamedExecContext(ctx, db, "INSERT INTO notifications (user_id, type, livestream_id, created_at) VALUES (:user_id, :type, :livestream_id, :created_at)", notificationModels); err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+// publishNotifications はSSEで待っているクライアントに知らせる。通知を積んだトランザクションをコミットしてから呼ぶこと
+func publishNotifications(ctx context.Context, notificationType string, userIDs []int64) error {
+	for _, userID := range userIDs {
+		if err := redisClient.Publish(ctx, fmt.Sprintf("%s%d", notificationChannelRedisKeyPrefix, userID), notificationType).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runLiveNotificationScheduler は開始時刻を迎えた配信を定期的に探してフォロワーに通知する。
+// 複数台で動かしても、live_notified_at を先に埋めたサーバだけが通知する
+func runLiveNotificationScheduler(ctx context.Context) {
+	ticker := time.NewTicker(liveNotificationScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := notifyStartedLivestreams(ctx); err != nil {
+				log.Printf("failed to notify started livestreams: %+v", err)
+			}
+		}
+	}
+}
+
+func notifyStartedLivestreams(ctx context.Context) error {
+	now := time.Now().Unix()
+
+	var livestreamModels []*LivestreamModel
+	query := "SELECT * FROM livestreams WHERE live_notified_at = 0 AND start_at <= ? AND start_at > ? AND end_at > ? AND cancelled_at = 0"
+	if err := dbConn.SelectContext(ctx, &livestreamModels, query, now, now-liveNotificationWindow, now); err != nil {
+		return err
+	}
+
+	// 1件失敗しても他の配信の通知は止めない
+	for _, livestreamModel := range livestreamModels {
+		if err := notifyStartedLivestream(ctx, now, livestreamModel); err != nil {
+			log.Printf("failed to notify started livestream %d: %+v", livestreamModel.ID, err)
+		}
+	}
+	return nil
+}
+
+// notifyStartedLivestream は live_notified_at を埋めるのと通知を積むのを同じトランザクションで行う。
+// 通知を積めなければ live_notified_at も戻るので、次の回で通知し直す
+func notifyStartedLivestream(ctx context.Context, now int64, livestreamModel *LivestreamModel) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rs, err := tx.ExecContext(ctx, "UPDATE livestreams SET live_notified_at = ? WHERE id = ? AND live_notified_at = 0", now, livestreamModel.ID)
+	if err != nil {
+		return err
+	}
+	claimed, err := rs.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if claimed == 0 {
+		// 他のサーバが通知した
+		return nil
+	}
+	livestreamModel.LiveNotifiedAt = now
+
+	userIDs, err := insertNotifications(ctx, tx, notificationTypeLive, livestreamModel)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return publishNotifications(ctx, notificationTypeLive, userIDs)
+}
+
+func fillNotificationResponse(ctx context.Context, tx *sqlx.Tx, notificationModel NotificationModel) (Notification, error) {
+	livestreamModel := LivestreamModel{}
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", notificationModel.LivestreamID); err != nil {
+		return Notification{}, err
+	}
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return Notification{}, err
+	}
+
+	return Notification{
+		ID:         notificationModel.ID,
+		Type:       notificationModel.Type,
+		Livestream: livestream,
+		Read:       notificationModel.ReadAt > 0,
+		CreatedAt:  notificationModel.CreatedAt,
+	}, nil
+}
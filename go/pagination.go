@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 配列を返す一覧で次ページのカーソルを入れるヘッダ
+const nextCursorHeader = "X-Next-Cursor"
+
+// pageCursor はソートキーの値をそのまま並べたもの。
+// ライブコメントなら (created_at, id)、配信なら (id) になる
+type pageCursor []int64
+
+func (cur pageCursor) String() string {
+	values := make([]string, len(cur))
+	for i, v := range cur {
+		values[i] = strconv.FormatInt(v, 10)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(values, ":")))
+}
+
+func parsePageCursor(s string, keys int) (pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	values := strings.Split(string(raw), ":")
+	if len(values) != keys {
+		return nil, errors.New("unexpected number of cursor keys")
+	}
+	cur := make(pageCursor, keys)
+	for i, v := range values {
+		cur[i], err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cur, nil
+}
+
+type pagination struct {
+	// 0のときはLIMITを付けない (limitが指定されていない)
+	Limit  int
+	Before pageCursor
+	After  pageCursor
+}
+
+// parsePagination は limit, before, after クエリパラメータを読む。keysはカーソルに含まれるソートキーの数
+func parsePagination(c echo.Context, keys int) (pagination, error) {
+	var p pagination
+
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return p, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be a positive integer")
+		}
+		p.Limit = limit
+	}
+
+	before, after := c.QueryParam("before"), c.QueryParam("after")
+	if before != "" && after != "" {
+		return p, echo.NewHTTPError(http.StatusBadRequest, "before and after query parameters can't be used together")
+	}
+	if before != "" {
+		cur, err := parsePageCursor(before, keys)
+		if err != nil {
+			return p, echo.NewHTTPError(http.StatusBadRequest, "invalid before cursor")
+		}
+		p.Before = cur
+	}
+	if after != "" {
+		cur, err := parsePageCursor(after, keys)
+		if err != nil {
+			return p, echo.NewHTTPError(http.StatusBadRequest, "invalid after cursor")
+		}
+		p.After = cur
+	}
+
+	return p, nil
+}
+
+// Forward は新しい方向 (after) に読み進めているかどうか
+func (p pagination) Forward() bool {
+	return p.After != nil
+}
+
+// Apply は降順に並ぶcolumnsに対して、カーソルの条件とORDER BY、LIMITをqueryに付け足す。
+// queryにはWHERE句まで書かれている必要がある。
+// afterのときは昇順で取ってくるので、呼び出し側で結果を反転させること
+func (p pagination) Apply(query string, args []interface{}, columns ...string) (string, []interface{}) {
+	return p.applyOrder(query, args, true, columns)
+}
+
+// ApplyAsc はApplyの昇順版。columnsは昇順に並び、beforeで後ろのページへ読み進める
+func (p pagination) ApplyAsc(query string, args []interface{}, columns ...string) (string, []interface{}) {
+	return p.applyOrder(query, args, false, columns)
+}
+
+func (p pagination) applyOrder(query string, args []interface{}, descending bool, columns []string) (string, []interface{}) {
+	// beforeは並び順どおり、afterは逆順に読む
+	beforeOp, beforeOrder, afterOp, afterOrder := "<", "DESC", ">", "ASC"
+	if !descending {
+		beforeOp, beforeOrder, afterOp, afterOrder = ">", "ASC", "<", "DESC"
+	}
+
+	cur, op, order := p.Before, beforeOp, beforeOrder
+	if p.Forward() {
+		cur, op, order = p.After, afterOp, afterOrder
+	}
+
+	if cur != nil {
+		cond, condArgs := keysetCondition(columns, cur, op)
+		query += " AND " + cond
+		args = append(args, condArgs...)
+	}
+
+	orders := make([]string, len(columns))
+	for i, column := range columns {
+		orders[i] = column + " " + order
+	}
+	query += " ORDER BY " + strings.Join(orders, ", ")
+
+	if p.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, p.Limit)
+	}
+	return query, args
+}
+
+// HasNext はこのページの続きがありそうかどうか。LIMITなしのときは全部返しているので続きはない
+func (p pagination) HasNext(n int) bool {
+	return p.Limit > 0 && n >= p.Limit
+}
+
+// keysetCondition は (a, b) < (?, ?) を、indexが効くように展開した条件を組み立てる
+func keysetCondition(columns []string, cur pageCursor, op string) (string, []interface{}) {
+	var (
+		ors  []string
+		args []interface{}
+	)
+	for i := range columns {
+		ands := make([]string, 0, i+1)
+		for j := 0; j < i; j++ {
+			ands = append(ands, columns[j]+" = ?")
+			args = append(args, cur[j])
+		}
+		ands = append(ands, fmt.Sprintf("%s %s ?", columns[i], op))
+		args = append(args, cur[i])
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+	return "(" + strings.Join(ors, " OR ") + ")", args
+}
+
+// applyPageToSlice はすでに並び順どおりに並んでいるitemsに対してカーソルとlimitを適用する。
+// DBでソートできない並び順 (Redisのスコア順など) に使う。keyはitemのソートキーを返し、並び順は降順とする
+func applyPageToSlice[T any](p pagination, items []T, key func(T) pageCursor) []T {
+	var filtered []T
+	for _, item := range items {
+		switch {
+		case p.Before != nil && compareCursor(key(item), p.Before) >= 0:
+			continue
+		case p.After != nil && compareCursor(key(item), p.After) <= 0:
+			continue
+		}
+		filtered = append(filtered, item)
+	}
+
+	if p.Limit == 0 || len(filtered) <= p.Limit {
+		return filtered
+	}
+	// afterのときはカーソルに近い側を返す
+	if p.Forward() {
+		return filtered[len(filtered)-p.Limit:]
+	}
+	return filtered[:p.Limit]
+}
+
+// compareCursor はカーソルを辞書順で比較する
+func compareCursor(a, b pageCursor) int {
+	for i := range a {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// PageResponse はページングする一覧のレスポンス。
+// next_cursor を before (afterで読んでいるときはafter) に渡すと続きが読める。続きがないときは空文字列
+type PageResponse[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor"`
+}
+
+func newPageResponse[T any](items []T, next pageCursor) PageResponse[T] {
+	res := PageResponse[T]{Items: items}
+	if next != nil {
+		res.NextCursor = next.String()
+	}
+	return res
+}
+
+// respondArrayPage はページングを入れる前から配列を返していた一覧 (ライブコメント・リアクション・配信検索) のレスポンス。
+// 既存のクライアントが読めるよう配列のまま返し、次ページのカーソルは X-Next-Cursor ヘッダに入れる。
+// envelope=true を付けたときだけ他の一覧と同じ PageResponse で返す
+func respondArrayPage[T any](c echo.Context, items []T, next pageCursor) error {
+	if c.QueryParam("envelope") == "true" {
+		return c.JSON(http.StatusOK, newPageResponse(items, next))
+	}
+	if next != nil {
+		c.Response().Header().Set(nextCursorHeader, next.String())
+	}
+	return c.JSON(http.StatusOK, items)
+}
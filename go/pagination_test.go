@@ -0,0 +1,215 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPageCursorRoundTrip(t *testing.T) {
+	for _, cur := range []pageCursor{{0}, {42}, {1700000000, 12345}, {-1, 3}} {
+		got, err := parsePageCursor(cur.String(), len(cur))
+		if err != nil {
+			t.Errorf("parsePageCursor(%v): %v", cur, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, cur) {
+			t.Errorf("parsePageCursor(%v.String()) = %v", cur, got)
+		}
+	}
+}
+
+func TestParsePageCursorRejectsInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		keys  int
+	}{
+		{"not base64", "!!!", 1},
+		{"too few keys", pageCursor{1}.String(), 2},
+		{"too many keys", pageCursor{1, 2}.String(), 1},
+		{"not an integer", "YWJj", 1}, // "abc"
+		{"empty", "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if cur, err := parsePageCursor(tt.input, tt.keys); err == nil {
+				t.Errorf("parsePageCursor(%q, %d) = %v, want an error", tt.input, tt.keys, cur)
+			}
+		})
+	}
+}
+
+func TestCompareCursor(t *testing.T) {
+	tests := []struct {
+		a, b pageCursor
+		want int
+	}{
+		{pageCursor{1}, pageCursor{1}, 0},
+		{pageCursor{1}, pageCursor{2}, -1},
+		{pageCursor{2}, pageCursor{1}, 1},
+		{pageCursor{1, 9}, pageCursor{2, 0}, -1},
+		{pageCursor{2, 0}, pageCursor{1, 9}, 1},
+		{pageCursor{5, 1}, pageCursor{5, 2}, -1},
+		{pageCursor{5, 2}, pageCursor{5, 1}, 1},
+		{pageCursor{5, 2}, pageCursor{5, 2}, 0},
+	}
+	for _, tt := range tests {
+		if got := compareCursor(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareCursor(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestKeysetCondition(t *testing.T) {
+	tests := []struct {
+		name     string
+		columns  []string
+		cur      pageCursor
+		op       string
+		wantCond string
+		wantArgs []interface{}
+	}{
+		{
+			name:     "one column",
+			columns:  []string{"id"},
+			cur:      pageCursor{10},
+			op:       "<",
+			wantCond: "((id < ?))",
+			wantArgs: []interface{}{int64(10)},
+		},
+		{
+			name:     "two columns",
+			columns:  []string{"created_at", "id"},
+			cur:      pageCursor{100, 7},
+			op:       ">",
+			wantCond: "((created_at > ?) OR (created_at = ? AND id > ?))",
+			wantArgs: []interface{}{int64(100), int64(100), int64(7)},
+		},
+		{
+			name:     "three columns",
+			columns:  []string{"a", "b", "c"},
+			cur:      pageCursor{1, 2, 3},
+			op:       "<",
+			wantCond: "((a < ?) OR (a = ? AND b < ?) OR (a = ? AND b = ? AND c < ?))",
+			wantArgs: []interface{}{int64(1), int64(1), int64(2), int64(1), int64(2), int64(3)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cond, args := keysetCondition(tt.columns, tt.cur, tt.op)
+			if cond != tt.wantCond {
+				t.Errorf("cond = %q, want %q", cond, tt.wantCond)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestPaginationApply(t *testing.T) {
+	const base = "SELECT * FROM livecomments WHERE livestream_id = ?"
+
+	tests := []struct {
+		name      string
+		page      pagination
+		ascending bool
+		wantQuery string
+		wantArgs  []interface{}
+	}{
+		{
+			name:      "first page without limit",
+			page:      pagination{},
+			wantQuery: base + " ORDER BY created_at DESC, id DESC",
+			wantArgs:  []interface{}{1},
+		},
+		{
+			name:      "before with limit",
+			page:      pagination{Limit: 10, Before: pageCursor{100, 7}},
+			wantQuery: base + " AND ((created_at < ?) OR (created_at = ? AND id < ?)) ORDER BY created_at DESC, id DESC LIMIT ?",
+			wantArgs:  []interface{}{1, int64(100), int64(100), int64(7), 10},
+		},
+		{
+			name:      "after reads in reverse",
+			page:      pagination{Limit: 10, After: pageCursor{100, 7}},
+			wantQuery: base + " AND ((created_at > ?) OR (created_at = ? AND id > ?)) ORDER BY created_at ASC, id ASC LIMIT ?",
+			wantArgs:  []interface{}{1, int64(100), int64(100), int64(7), 10},
+		},
+		{
+			name:      "ascending before",
+			page:      pagination{Limit: 5, Before: pageCursor{100, 7}},
+			ascending: true,
+			wantQuery: base + " AND ((created_at > ?) OR (created_at = ? AND id > ?)) ORDER BY created_at ASC, id ASC LIMIT ?",
+			wantArgs:  []interface{}{1, int64(100), int64(100), int64(7), 5},
+		},
+		{
+			name:      "ascending after reads in reverse",
+			page:      pagination{After: pageCursor{100, 7}},
+			ascending: true,
+			wantQuery: base + " AND ((created_at < ?) OR (created_at = ? AND id < ?)) ORDER BY created_at DESC, id DESC",
+			wantArgs:  []interface{}{1, int64(100), int64(100), int64(7)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apply := tt.page.Apply
+			if tt.ascending {
+				apply = tt.page.ApplyAsc
+			}
+			query, args := apply(base, []interface{}{1}, "created_at", "id")
+			if query != tt.wantQuery {
+				t.Errorf("query = %q, want %q", query, tt.wantQuery)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestPaginationHasNext(t *testing.T) {
+	tests := []struct {
+		limit int
+		n     int
+		want  bool
+	}{
+		{0, 100, false},
+		{10, 9, false},
+		{10, 10, true},
+	}
+	for _, tt := range tests {
+		if got := (pagination{Limit: tt.limit}).HasNext(tt.n); got != tt.want {
+			t.Errorf("HasNext with limit %d and %d items = %v, want %v", tt.limit, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestApplyPageToSlice(t *testing.T) {
+	// スコアの降順、同じスコアならIDの降順
+	items := []pageCursor{{9, 5}, {7, 4}, {7, 3}, {5, 2}, {1, 1}}
+	key := func(item pageCursor) pageCursor { return item }
+
+	tests := []struct {
+		name string
+		page pagination
+		want []pageCursor
+	}{
+		{"everything", pagination{}, items},
+		{"limit", pagination{Limit: 2}, []pageCursor{{9, 5}, {7, 4}}},
+		{"before", pagination{Before: pageCursor{7, 4}}, []pageCursor{{7, 3}, {5, 2}, {1, 1}}},
+		{"before with limit", pagination{Limit: 2, Before: pageCursor{7, 4}}, []pageCursor{{7, 3}, {5, 2}}},
+		{"after", pagination{After: pageCursor{7, 3}}, []pageCursor{{9, 5}, {7, 4}}},
+		// afterのときはカーソルに近い側を返す
+		{"after with limit", pagination{Limit: 1, After: pageCursor{5, 2}}, []pageCursor{{7, 3}}},
+		{"before the last item", pagination{Before: pageCursor{1, 1}}, nil},
+		{"limit larger than items", pagination{Limit: 10, Before: pageCursor{5, 2}}, []pageCursor{{1, 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := applyPageToSlice(tt.page, items, key)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
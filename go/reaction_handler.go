@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
 )
 
 type ReactionModel struct {
@@ -46,26 +51,35 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
+	page, err := parsePagination(c, 2)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	// FIXME: index
-	query := "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC"
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
-	}
+	// (created_at, id) のカーソルで livestream_id_and_created_at のindexを使う
+	query, args := page.Apply("SELECT * FROM reactions WHERE livestream_id = ?", []interface{}{livestreamID}, "created_at", "id")
 
 	reactionModels := []ReactionModel{}
-	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &reactionModels, query, args...); err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
 	}
+	if page.Forward() {
+		slices.Reverse(reactionModels)
+	}
+	var next pageCursor
+	if page.HasNext(len(reactionModels)) {
+		last := reactionModels[len(reactionModels)-1]
+		if page.Forward() {
+			last = reactionModels[0]
+		}
+		next = pageCursor{last.CreatedAt, last.ID}
+	}
 
 	reactions := make([]Reaction, len(reactionModels))
 	for i := range reactionModels {
@@ -82,7 +96,7 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, reactions)
+	return respondArrayPage(c, reactions, next)
 }
 
 func postReactionHandler(c echo.Context) error {
@@ -107,65 +121,202 @@ func postReactionHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
+	reaction, err := createReaction(ctx, userID, int64(livestreamID), req.EmojiName)
+	if err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, reaction)
+}
+
+// リアクションの投稿と集約されたリアクション数の受信 (WebSocket)
+// GET /api/livestream/:livestream_id/reaction/ws
+func reactionWebSocketHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var exists bool
+	if err := dbConn.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM livestreams WHERE id = ?)", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+	}
+
+	// Cookieで認証しているので、他のサイトのページから接続させない
+	allowMissingOrigin := c.Get(apiTokenIDContextKey) != nil
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			return verifyWebSocketOrigin(config, req, allowMissingOrigin)
+		},
+	}
+	server.Handler = func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		client := reactionHubInstance.join(int64(livestreamID))
+		defer reactionHubInstance.leave(int64(livestreamID), client)
+
+		// 書き込みはこのgoroutineだけで行う
+		errs := make(chan ReactionStreamError, 1)
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				var frame interface{}
+				select {
+				case <-done:
+					return
+				case batch, ok := <-client.send:
+					if !ok {
+						return
+					}
+					frame = batch
+				case e := <-errs:
+					frame = e
+				}
+				if err := websocket.JSON.Send(ws, frame); err != nil {
+					ws.Close()
+					return
+				}
+			}
+		}()
+
+		for {
+			var req PostReactionRequest
+			if err := websocket.JSON.Receive(ws, &req); err != nil {
+				return
+			}
+
+			if _, err := createReaction(ctx, userID, int64(livestreamID), req.EmojiName); err != nil {
+				c.Logger().Warnf("failed to create reaction via websocket: %+v", err)
+				select {
+				case errs <- ReactionStreamError{Type: reactionStreamMessageError, Error: err.Error()}:
+				default:
+				}
+			}
+		}
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+
+	return nil
+}
+
+// verifyWebSocketOrigin はOriginがこのアプリのホストと一致するか確かめる。
+// Originを送らないのはブラウザ以外なので、APIトークンで認証したときだけ許す
+func verifyWebSocketOrigin(config *websocket.Config, req *http.Request, allowMissingOrigin bool) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil {
+		if allowMissingOrigin {
+			return nil
+		}
+		return errors.New("websocket: missing origin")
+	}
+	if origin.Host != req.Host {
+		return fmt.Errorf("websocket: cross-origin request from %s", origin.Host)
+	}
+	config.Origin = origin
+	return nil
+}
+
+// createReaction はリアクションを登録し、リーダーボードと集計用のカウンタを更新する。
+// REST APIとWebSocketの両方から呼ばれる
+func createReaction(ctx context.Context, userID int64, livestreamID int64, emojiName string) (Reaction, error) {
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Reaction{}, echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if err := verifyLivestreamAcceptsActivity(livestreamModel); err != nil {
+		return Reaction{}, err
+	}
+
 	reactionModel := ReactionModel{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
-		EmojiName:    req.EmojiName,
+		UserID:       userID,
+		LivestreamID: livestreamID,
+		EmojiName:    emojiName,
 		CreatedAt:    time.Now().Unix(),
 	}
 
 	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
 	}
 
 	reactionID, err := result.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
 	}
 	reactionModel.ID = reactionID
 
 	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	err = redisClient.ZIncrBy(ctx, LivestreamLeaderBoardRedisKey, 1, c.Param("livestream_id")).Err()
+	err = redisClient.ZIncrBy(ctx, LivestreamLeaderBoardRedisKey, 1, strconv.FormatInt(livestreamID, 10)).Err()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to incr the leader board: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to incr the leader board: "+err.Error())
 	}
 
-	livestreamUserIDStr, err := redisClient.Get(ctx, fmt.Sprintf("%s%d", livestreamID2UserIDCachePrefix, livestreamID)).Result()
+	livestreamReactions, err := redisClient.Incr(ctx, fmt.Sprintf("%s%d", livestreamReactionsCachePrefix, livestreamID)).Result()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to incr the leader board: "+err.Error())
-	}
-	livestreamUserID, _ := strconv.ParseInt(livestreamUserIDStr, 10, 64)
-	err = redisClient.ZIncrBy(ctx, UserLeaderBoardRedisKey, 1, strconv.FormatInt(livestreamUserID, 10)).Err()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to incr the leader board: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to incr the num of livestream reactions: "+err.Error())
 	}
 
-	err = redisClient.Incr(ctx, fmt.Sprintf("%s%d", livestreamReactionsCachePrefix, livestreamID)).Err()
+	// 配信者はトランザクションの最初に引いているので、livestream2userのキャッシュは見なくてよい
+	livestreamUserID := livestreamModel.UserID
+	err = incrUserLeaderBoardForHosts(ctx, livestreamModel, livestreamReactions-1, livestreamReactions)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to incr the num of livestream reactions: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to incr the leader board: "+err.Error())
 	}
 
 	err = redisClient.Incr(ctx, fmt.Sprintf("%s%d", userReactionsCachePrefix, livestreamUserID)).Err()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to incr the num of user reactions: "+err.Error())
+		return Reaction{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to incr the num of user reactions: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, reaction)
+	// WebSocketで視聴中のクライアントへ集約して配信する。
+	// リアクションはコミット済みで集計にも入っているので、配信できなくても成功として返す
+	if err := redisClient.Publish(ctx, fmt.Sprintf("%s%d", reactionChannelRedisKeyPrefix, livestreamID), emojiName).Err(); err != nil {
+		log.Printf("failed to publish reaction for livestream %d: %+v", livestreamID, err)
+	}
+
+	// リアクションはコミット済みなので、Webhookを積めなくてもリアクションは成功として返す
+	if err := enqueueReactionBurstWebhook(ctx, livestreamModel); err != nil {
+		log.Printf("failed to enqueue %s webhook for livestream %d: %+v", webhookEventReactionBurst, livestreamModel.ID, err)
+	}
+
+	return reaction, nil
 }
 
 // FIXME: user情報に応じて個別に2つクエリを発行しておる。JOINにして1發で引いたほうがよくない？
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ライブストリームのIDをappendして使うこと
+const reactionChannelRedisKeyPrefix = "reaction_channel:"
+
+// この間隔ごとにリアクションを集約してWebSocketクライアントへ送る
+const reactionBatchInterval = 300 * time.Millisecond
+
+// WebSocketで送るフレームの種類
+const (
+	reactionStreamMessageBatch = "reactions"
+	reactionStreamMessageError = "error"
+)
+
+// 送信が詰まっているクライアントにはフレームを捨てる
+const reactionClientSendBuffer = 16
+
+// ReactionBatch は一定間隔ごとに集約したリアクション数
+type ReactionBatch struct {
+	Type         string `json:"type"`
+	LivestreamID int64  `json:"livestream_id"`
+	// 前回のフレームからの絵文字ごとの増分
+	Counts map[string]int64 `json:"counts"`
+	// num_reactions:livestream: のカウンタの値 (統計情報と同じ値)
+	TotalReactions int64 `json:"total_reactions"`
+	CreatedAt      int64 `json:"created_at"`
+}
+
+type ReactionStreamError struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+type reactionClient struct {
+	send chan ReactionBatch
+}
+
+// reactionRoom はライブストリームごとの購読と集約を担う。
+// 他サーバでのリアクションも拾えるようにRedisのpub/subを購読する
+type reactionRoom struct {
+	livestreamID int64
+	clients      map[*reactionClient]struct{}
+	cancel       context.CancelFunc
+
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+type reactionHub struct {
+	mu    sync.Mutex
+	rooms map[int64]*reactionRoom
+}
+
+var reactionHubInstance = &reactionHub{
+	rooms: make(map[int64]*reactionRoom),
+}
+
+func (h *reactionHub) join(livestreamID int64) *reactionClient {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	room, ok := h.rooms[livestreamID]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		room = &reactionRoom{
+			livestreamID: livestreamID,
+			clients:      make(map[*reactionClient]struct{}),
+			cancel:       cancel,
+			counts:       make(map[string]int64),
+		}
+		h.rooms[livestreamID] = room
+		go room.run(ctx, h)
+	}
+
+	client := &reactionClient{
+		send: make(chan ReactionBatch, reactionClientSendBuffer),
+	}
+	room.clients[client] = struct{}{}
+	return client
+}
+
+func (h *reactionHub) leave(livestreamID int64, client *reactionClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	room, ok := h.rooms[livestreamID]
+	if !ok {
+		return
+	}
+	if _, ok := room.clients[client]; !ok {
+		return
+	}
+	delete(room.clients, client)
+	close(client.send)
+
+	// 最後の視聴者がいなくなったら購読をやめる
+	if len(room.clients) == 0 {
+		room.cancel()
+		delete(h.rooms, livestreamID)
+	}
+}
+
+func (h *reactionHub) broadcast(room *reactionRoom, batch ReactionBatch) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range room.clients {
+		select {
+		case client.send <- batch:
+		default:
+			// 遅いクライアントのためにルーム全体を止めない
+		}
+	}
+}
+
+func (r *reactionRoom) run(ctx context.Context, h *reactionHub) {
+	pubsub := redisClient.Subscribe(ctx, fmt.Sprintf("%s%d", reactionChannelRedisKeyPrefix, r.livestreamID))
+	defer pubsub.Close()
+
+	ticker := time.NewTicker(reactionBatchInterval)
+	defer ticker.Stop()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			r.mu.Lock()
+			r.counts[msg.Payload]++
+			r.mu.Unlock()
+		case <-ticker.C:
+			r.mu.Lock()
+			counts := r.counts
+			if len(counts) == 0 {
+				r.mu.Unlock()
+				continue
+			}
+			r.counts = make(map[string]int64)
+			r.mu.Unlock()
+
+			total, err := getLivestreamReactionCount(ctx, r.livestreamID)
+			if err != nil {
+				log.Printf("failed to get the num of livestream reactions: %+v", err)
+				continue
+			}
+			h.broadcast(r, ReactionBatch{
+				Type:           reactionStreamMessageBatch,
+				LivestreamID:   r.livestreamID,
+				Counts:         counts,
+				TotalReactions: total,
+				CreatedAt:      time.Now().Unix(),
+			})
+		}
+	}
+}
+
+func getLivestreamReactionCount(ctx context.Context, livestreamID int64) (int64, error) {
+	countStr, err := redisClient.Get(ctx, fmt.Sprintf("%s%d", livestreamReactionsCachePrefix, livestreamID)).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(countStr, 10, 64)
+}
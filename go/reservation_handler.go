@@ -0,0 +1,723 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 予約枠は1時間単位
+const reservationSlotDuration = 60 * 60
+
+// 予約受付期間。この期間内に予約枠が生成される
+type ReservationTermModel struct {
+	ID           int64 `db:"id" json:"id"`
+	StartAt      int64 `db:"start_at" json:"start_at"`
+	EndAt        int64 `db:"end_at" json:"end_at"`
+	SlotCapacity int64 `db:"slot_capacity" json:"slot_capacity"`
+	CreatedAt    int64 `db:"created_at" json:"created_at"`
+}
+
+// メンテナンスなどで予約を受け付けない期間
+type ReservationBlackoutModel struct {
+	ID        int64  `db:"id" json:"id"`
+	StartAt   int64  `db:"start_at" json:"start_at"`
+	EndAt     int64  `db:"end_at" json:"end_at"`
+	Reason    string `db:"reason" json:"reason"`
+	CreatedAt int64  `db:"created_at" json:"created_at"`
+}
+
+type PostReservationTermRequest struct {
+	StartAt      int64 `json:"start_at"`
+	EndAt        int64 `json:"end_at"`
+	SlotCapacity int64 `json:"slot_capacity"`
+}
+
+type ExtendReservationTermRequest struct {
+	EndAt int64 `json:"end_at"`
+}
+
+type PostReservationBlackoutRequest struct {
+	StartAt int64  `json:"start_at"`
+	EndAt   int64  `json:"end_at"`
+	Reason  string `json:"reason"`
+}
+
+// 予約枠一覧でfrom, toを省略したときに返す期間
+const defaultReservationSlotsRange = 7 * 24 * 60 * 60
+
+type ReservationSlot struct {
+	StartAt   int64 `json:"start_at"`
+	EndAt     int64 `json:"end_at"`
+	Remaining int64 `json:"remaining"`
+}
+
+type ReservationWindow struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+}
+
+type UpdateReservationRequest struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+}
+
+// verifyReservationTerm は予約区間が予約受付期間に収まっていて、
+// メンテナンス期間にかかっていないことをチェックする。区間にかかる予約受付期間を開始時刻順に返す
+func verifyReservationTerm(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) ([]*ReservationTermModel, error) {
+	if startAt >= endAt {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	}
+
+	var terms []*ReservationTermModel
+	if err := tx.SelectContext(ctx, &terms, "SELECT * FROM reservation_terms WHERE start_at < ? AND end_at > ? ORDER BY start_at", endAt, startAt); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_terms: "+err.Error())
+	}
+	if !reservationTermsCover(terms, startAt, endAt) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約区間 %d ~ %dを含む予約受付期間がありません", startAt, endAt))
+	}
+
+	var blackouts []*ReservationBlackoutModel
+	if err := tx.SelectContext(ctx, &blackouts, "SELECT * FROM reservation_blackouts WHERE start_at < ? AND end_at > ? ORDER BY start_at LIMIT 1", endAt, startAt); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_blackouts: "+err.Error())
+	}
+	if len(blackouts) > 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約区間 %d ~ %dはメンテナンス期間 %d ~ %d (%s) にかかっているため予約できません", startAt, endAt, blackouts[0].StartAt, blackouts[0].EndAt, blackouts[0].Reason))
+	}
+
+	return terms, nil
+}
+
+// reservationTermsCover は開始時刻順に並んだ予約受付期間が区間のすべての時間を含んでいるかどうか。
+// 予約受付期間は隣り合っていてもよいので、1時間ごとにいずれかの期間に含まれているか確かめる
+func reservationTermsCover(terms []*ReservationTermModel, startAt, endAt int64) bool {
+	i := 0
+	for t := startAt - startAt%reservationSlotDuration; t < endAt; t += reservationSlotDuration {
+		for i < len(terms) && terms[i].EndAt <= t {
+			i++
+		}
+		if i == len(terms) || terms[i].StartAt > t {
+			return false
+		}
+	}
+	return true
+}
+
+// reservationSlotCount は区間にまるごと含まれる予約枠の数。予約するとこの数だけ枠が減る
+func reservationSlotCount(startAt, endAt int64) int64 {
+	first := (startAt + reservationSlotDuration - 1) / reservationSlotDuration
+	last := endAt / reservationSlotDuration
+	return max(last-first, 0)
+}
+
+// lockReservationSlots は区間内の予約枠を FOR UPDATE で取得する
+// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
+func lockReservationSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) ([]*ReservationSlotModel, error) {
+	var slots []*ReservationSlotModel
+	// FIXME: indexきいてるかみてくれ
+	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", startAt, endAt); err != nil {
+		return nil, err
+	}
+	return slots, nil
+}
+
+// claimReservationSlots は区間内の予約枠がすべて空いていることを確かめてから1つずつ確保する。
+// termsは verifyReservationTerm が返した予約受付期間。失敗した場合はecho.HTTPErrorを返す
+func claimReservationSlots(ctx context.Context, tx *sqlx.Tx, terms []*ReservationTermModel, startAt, endAt int64) error {
+	unavailable := echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", terms[0].StartAt, terms[len(terms)-1].EndAt, startAt, endAt))
+
+	slots, err := lockReservationSlots(ctx, tx, startAt, endAt)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+	for _, slot := range slots {
+		if slot.Slot < 1 {
+			return unavailable
+		}
+	}
+
+	// FIXME: indexきいてるかみてくれ
+	rs, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+	claimed, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+	// 予約枠の行がない時間があれば、その時間は予約できない
+	if claimed < reservationSlotCount(startAt, endAt) {
+		return unavailable
+	}
+	return nil
+}
+
+// releaseReservationSlots は区間内の予約枠を1つずつ返却する
+func releaseReservationSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) error {
+	if _, err := lockReservationSlots(ctx, tx, startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+	return nil
+}
+
+// lockOwnedScheduledLivestream は自分の配信を FOR UPDATE で取得し、まだ開始していないことを確かめる
+func lockOwnedScheduledLivestream(ctx context.Context, tx *sqlx.Tx, livestreamID int64, userID int64) (LivestreamModel, error) {
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamModel{}, echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusForbidden, "can't change other streamer's reservation")
+	}
+	if status := livestreamModel.Status(time.Now().Unix()); status != livestreamStatusScheduled {
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reservation can't be changed (status: %s)", status))
+	}
+	return livestreamModel, nil
+}
+
+// cancelLivestream は予約枠を返却して配信をキャンセル済みにする。
+// 失敗した場合はecho.HTTPErrorを返す
+func cancelLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel *LivestreamModel) error {
+	if err := releaseReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+		return err
+	}
+
+	livestreamModel.CancelledAt = time.Now().Unix()
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET cancelled_at = ? WHERE id = ?", livestreamModel.CancelledAt, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to cancel livestream: "+err.Error())
+	}
+	return nil
+}
+
+// 配信予約のキャンセル
+// DELETE /api/livestream/:livestream_id/reservation
+func cancelReservationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := lockOwnedScheduledLivestream(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+
+	if err := cancelLivestream(ctx, tx, &livestreamModel); err != nil {
+		return err
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// 配信予約の時間変更
+// PATCH /api/livestream/:livestream_id/reservation
+func updateReservationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	req := UpdateReservationRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.StartAt <= time.Now().Unix() {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't reschedule a livestream into the past")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	terms, err := verifyReservationTerm(ctx, tx, req.StartAt, req.EndAt)
+	if err != nil {
+		return err
+	}
+
+	livestreamModel, err := lockOwnedScheduledLivestream(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+
+	// デッドロックしないように、新旧両方の区間をまとめて先にロックしておく
+	if _, err := lockReservationSlots(ctx, tx, min(livestreamModel.StartAt, req.StartAt), max(livestreamModel.EndAt, req.EndAt)); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+	if err := releaseReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+		return err
+	}
+	if err := claimReservationSlots(ctx, tx, terms, req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+
+	livestreamModel.StartAt = req.StartAt
+	livestreamModel.EndAt = req.EndAt
+	if _, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET start_at = :start_at, end_at = :end_at WHERE id = :id", livestreamModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// parseUnixQueryParam はUNIX時刻のクエリパラメータを読む。省略時はdefaultValueを返す
+func parseUnixQueryParam(c echo.Context, name string, defaultValue int64) (int64, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return defaultValue, nil
+	}
+	t, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, name+" query parameter must be unix time")
+	}
+	return t, nil
+}
+
+// 予約枠の空き状況
+// GET /api/reservation_slots?from=&to=
+func getReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	from, err := parseUnixQueryParam(c, "from", time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	to, err := parseUnixQueryParam(c, "to", from+defaultReservationSlotsRange)
+	if err != nil {
+		return err
+	}
+	if from >= to {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+	}
+
+	// 予約枠は予約受付期間の中にしか作られないので、期間外は自然に除かれる
+	slotModels, err := getAvailableReservationSlots(ctx, from, to)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	slots := make([]ReservationSlot, len(slotModels))
+	for i, slotModel := range slotModels {
+		slots[i] = ReservationSlot{
+			StartAt:   slotModel.StartAt,
+			EndAt:     slotModel.EndAt,
+			Remaining: max(slotModel.Slot, 0),
+		}
+	}
+
+	return c.JSON(http.StatusOK, slots)
+}
+
+// 指定した時間数だけ連続して予約できる、最も早い区間を探す
+// GET /api/reservation_slots/next_free?hours=&from=
+func getNextFreeReservationWindowHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	hours, err := strconv.Atoi(c.QueryParam("hours"))
+	if err != nil || hours < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "hours query parameter must be a positive integer")
+	}
+	from, err := parseUnixQueryParam(c, "from", time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	var horizon int64
+	if err := dbConn.GetContext(ctx, &horizon, "SELECT IFNULL(MAX(end_at), 0) FROM reservation_terms"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_terms: "+err.Error())
+	}
+
+	slotModels, err := getAvailableReservationSlots(ctx, from, horizon)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	// 空きのある枠が途切れずにhours個続くところを探す
+	run := 0
+	var windowStartAt int64
+	for i, slot := range slotModels {
+		if slot.Slot < 1 || (run > 0 && slotModels[i-1].EndAt != slot.StartAt) {
+			run = 0
+		}
+		if slot.Slot < 1 {
+			continue
+		}
+		if run == 0 {
+			windowStartAt = slot.StartAt
+		}
+		run++
+		if run == hours {
+			return c.JSON(http.StatusOK, ReservationWindow{
+				StartAt: windowStartAt,
+				EndAt:   slot.EndAt,
+			})
+		}
+	}
+
+	return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no free reservation window of %d hours", hours))
+}
+
+// getAvailableReservationSlots は区間内の予約枠を開始時刻順に返す。
+// メンテナンス期間にかかる枠は残数を0として扱う
+func getAvailableReservationSlots(ctx context.Context, from, to int64) ([]*ReservationSlotModel, error) {
+	var slots []*ReservationSlotModel
+	// FIXME: indexきいてるかみてくれ
+	if err := dbConn.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at", from, to); err != nil {
+		return nil, err
+	}
+
+	var blackouts []*ReservationBlackoutModel
+	if err := dbConn.SelectContext(ctx, &blackouts, "SELECT * FROM reservation_blackouts WHERE start_at < ? AND end_at > ?", to, from); err != nil {
+		return nil, err
+	}
+	for _, slot := range slots {
+		for _, blackout := range blackouts {
+			if slot.StartAt < blackout.EndAt && slot.EndAt > blackout.StartAt {
+				slot.Slot = 0
+				break
+			}
+		}
+	}
+
+	return slots, nil
+}
+
+// 予約受付期間の一覧 (管理者向け)
+// GET /api/admin/reservation_terms
+func getReservationTermsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdmin(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	terms := []ReservationTermModel{}
+	if err := dbConn.SelectContext(ctx, &terms, "SELECT * FROM reservation_terms ORDER BY start_at"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_terms: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, terms)
+}
+
+// 予約受付期間の追加と予約枠の生成 (管理者向け)
+// POST /api/admin/reservation_terms
+func postReservationTermHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	req := PostReservationTermRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := verifyReservationSlotRange(req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+	if req.SlotCapacity < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "slot_capacity must be a positive integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyReservationTermNotOverlapping(ctx, tx, 0, req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+
+	term := ReservationTermModel{
+		StartAt:      req.StartAt,
+		EndAt:        req.EndAt,
+		SlotCapacity: req.SlotCapacity,
+		CreatedAt:    time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_terms (start_at, end_at, slot_capacity, created_at) VALUES (:start_at, :end_at, :slot_capacity, :created_at)", term)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation_term: "+err.Error())
+	}
+	termID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reservation_term id: "+err.Error())
+	}
+	term.ID = termID
+
+	if err := generateReservationSlots(ctx, tx, term.StartAt, term.EndAt, term.SlotCapacity); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate reservation_slots: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, term)
+}
+
+// 予約受付期間の延長 (管理者向け)
+// POST /api/admin/reservation_terms/:term_id/extend
+func extendReservationTermHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	termID, err := strconv.ParseInt(c.Param("term_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "term_id in path must be integer")
+	}
+
+	req := ExtendReservationTermRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var term ReservationTermModel
+	if err := tx.GetContext(ctx, &term, "SELECT * FROM reservation_terms WHERE id = ? FOR UPDATE", termID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "reservation term not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_term: "+err.Error())
+	}
+	if req.EndAt <= term.EndAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "end_at must be after the current end of the term")
+	}
+	if err := verifyReservationSlotRange(term.EndAt, req.EndAt); err != nil {
+		return err
+	}
+	if err := verifyReservationTermNotOverlapping(ctx, tx, term.ID, term.EndAt, req.EndAt); err != nil {
+		return err
+	}
+
+	if err := generateReservationSlots(ctx, tx, term.EndAt, req.EndAt, term.SlotCapacity); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate reservation_slots: "+err.Error())
+	}
+	term.EndAt = req.EndAt
+	if _, err := tx.NamedExecContext(ctx, "UPDATE reservation_terms SET end_at = :end_at WHERE id = :id", term); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_term: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, term)
+}
+
+// メンテナンス期間の一覧 (管理者向け)
+// GET /api/admin/reservation_blackouts
+func getReservationBlackoutsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdmin(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	blackouts := []ReservationBlackoutModel{}
+	if err := dbConn.SelectContext(ctx, &blackouts, "SELECT * FROM reservation_blackouts ORDER BY start_at"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_blackouts: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, blackouts)
+}
+
+// メンテナンス期間の登録 (管理者向け)
+// 既存の予約はそのまま残り、新しい予約だけを受け付けなくなる
+// POST /api/admin/reservation_blackouts
+func postReservationBlackoutHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	req := PostReservationBlackoutRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.StartAt >= req.EndAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at must be before end_at")
+	}
+
+	blackout := ReservationBlackoutModel{
+		StartAt:   req.StartAt,
+		EndAt:     req.EndAt,
+		Reason:    req.Reason,
+		CreatedAt: time.Now().Unix(),
+	}
+	rs, err := dbConn.NamedExecContext(ctx, "INSERT INTO reservation_blackouts (start_at, end_at, reason, created_at) VALUES (:start_at, :end_at, :reason, :created_at)", blackout)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation_blackout: "+err.Error())
+	}
+	blackoutID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reservation_blackout id: "+err.Error())
+	}
+	blackout.ID = blackoutID
+
+	return c.JSON(http.StatusCreated, blackout)
+}
+
+// メンテナンス期間の削除 (管理者向け)
+// DELETE /api/admin/reservation_blackouts/:blackout_id
+func deleteReservationBlackoutHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdmin(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	blackoutID, err := strconv.ParseInt(c.Param("blackout_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "blackout_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM reservation_blackouts WHERE id = ?", blackoutID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete reservation_blackout: "+err.Error())
+	}
+	if n, err := rs.RowsAffected(); err == nil && n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "reservation blackout not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// verifyReservationSlotRange は予約枠を生成できる (1時間単位で区切られた) 区間かをチェックする
+func verifyReservationSlotRange(startAt, endAt int64) error {
+	if startAt >= endAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at must be before end_at")
+	}
+	if startAt%reservationSlotDuration != 0 || endAt%reservationSlotDuration != 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at and end_at must be on the hour")
+	}
+	return nil
+}
+
+// verifyReservationTermNotOverlapping は他の予約受付期間と重ならないことをチェックする。
+// 重なると同じ時間帯の予約枠が二重に生成されてしまう
+func verifyReservationTermNotOverlapping(ctx context.Context, tx *sqlx.Tx, excludeTermID int64, startAt, endAt int64) error {
+	var overlapping bool
+	if err := tx.GetContext(ctx, &overlapping, "SELECT EXISTS(SELECT 1 FROM reservation_terms WHERE id != ? AND start_at < ? AND end_at > ?)", excludeTermID, endAt, startAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_terms: "+err.Error())
+	}
+	if overlapping {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("区間 %d ~ %dは既存の予約受付期間と重なっています", startAt, endAt))
+	}
+	return nil
+}
+
+// generateReservationSlots は区間を1時間ごとに区切って予約枠を作る
+func generateReservationSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64, capacity int64) error {
+	// プレースホルダの上限に引っかからないように分けてINSERTする
+	const chunkSize = 1000
+
+	slots := make([]ReservationSlotModel, 0, chunkSize)
+	for t := startAt; t < endAt; t += reservationSlotDuration {
+		slots = append(slots, ReservationSlotModel{
+			Slot:    capacity,
+			StartAt: t,
+			EndAt:   t + reservationSlotDuration,
+		})
+		if len(slots) == chunkSize || t+reservationSlotDuration >= endAt {
+			if _, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (:slot, :start_at, :end_at)", slots); err != nil {
+				return err
+			}
+			slots = slots[:0]
+		}
+	}
+	return nil
+}
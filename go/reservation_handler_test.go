@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestReservationTermsCover(t *testing.T) {
+	const h = reservationSlotDuration
+	term := func(startHour, endHour int64) *ReservationTermModel {
+		return &ReservationTermModel{StartAt: startHour * h, EndAt: endHour * h}
+	}
+
+	tests := []struct {
+		name           string
+		terms          []*ReservationTermModel
+		startAt, endAt int64
+		want           bool
+	}{
+		{"no terms", nil, 1 * h, 2 * h, false},
+		{"inside one term", []*ReservationTermModel{term(0, 10)}, 2 * h, 5 * h, true},
+		{"exactly one term", []*ReservationTermModel{term(0, 10)}, 0, 10 * h, true},
+		{"runs past the end", []*ReservationTermModel{term(0, 10)}, 9 * h, 11 * h, false},
+		{"starts before the term", []*ReservationTermModel{term(5, 10)}, 4 * h, 6 * h, false},
+		{"spans adjacent terms", []*ReservationTermModel{term(0, 10), term(10, 20)}, 9 * h, 11 * h, true},
+		{"spans three adjacent terms", []*ReservationTermModel{term(0, 2), term(2, 3), term(3, 6)}, 1 * h, 5 * h, true},
+		{"gap between terms", []*ReservationTermModel{term(0, 10), term(11, 20)}, 9 * h, 12 * h, false},
+		{"after a gap", []*ReservationTermModel{term(0, 10), term(11, 20)}, 11 * h, 12 * h, true},
+		// 区切りに揃っていない区間は、かかっている時間がすべて含まれていればよい
+		{"unaligned inside", []*ReservationTermModel{term(0, 10)}, 2*h + 30*60, 3*h + 30*60, true},
+		{"unaligned into a gap", []*ReservationTermModel{term(0, 10)}, 9*h + 30*60, 10*h + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reservationTermsCover(tt.terms, tt.startAt, tt.endAt); got != tt.want {
+				t.Errorf("reservationTermsCover(%d, %d) = %v, want %v", tt.startAt, tt.endAt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReservationSlotCount(t *testing.T) {
+	const h = reservationSlotDuration
+
+	tests := []struct {
+		name           string
+		startAt, endAt int64
+		want           int64
+	}{
+		{"one hour", 0, h, 1},
+		{"three hours", 2 * h, 5 * h, 3},
+		{"shorter than a slot", 0, h - 1, 0},
+		{"unaligned start", 30 * 60, 3 * h, 2},
+		{"unaligned end", h, 3*h + 30*60, 2},
+		{"inside one slot", 10 * 60, 50 * 60, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reservationSlotCount(tt.startAt, tt.endAt); got != tt.want {
+				t.Errorf("reservationSlotCount(%d, %d) = %d, want %d", tt.startAt, tt.endAt, got, tt.want)
+			}
+		})
+	}
+}
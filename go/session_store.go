@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// SESSIONIDをappendして使うこと
+const sessionRedisKeyPrefix = "session:"
+
+// ユーザIDをappendして使うこと。SESSIONIDを有効期限をスコアにして持つ
+const userSessionsRedisKeyPrefix = "user_sessions:"
+
+// ログインしてからセッションが切れるまでの時間
+const sessionLifetime = 1 * time.Hour
+
+// SessionModel はRedisに保存するセッション。
+// Cookieにも同じ値が入っているが、失効させられるようにサーバ側の記録を正とする
+type SessionModel struct {
+	ID        string `json:"id"`
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	UserAgent string `json:"user_agent"`
+	RemoteIP  string `json:"remote_ip"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type Session struct {
+	ID        string `json:"id"`
+	UserAgent string `json:"user_agent"`
+	RemoteIP  string `json:"remote_ip"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at"`
+	// このリクエストのセッションかどうか
+	Current bool `json:"current"`
+}
+
+// saveSession はセッションをRedisに保存する。有効期限が来たら自動で消える
+func saveSession(ctx context.Context, sessionModel SessionModel) error {
+	payload, err := json.Marshal(sessionModel)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Until(time.Unix(sessionModel.ExpiresAt, 0))
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sessionRedisKeyPrefix+sessionModel.ID, payload, ttl)
+		pipe.ZAdd(ctx, fmt.Sprintf("%s%d", userSessionsRedisKeyPrefix, sessionModel.UserID), redis.Z{
+			Score:  float64(sessionModel.ExpiresAt),
+			Member: sessionModel.ID,
+		})
+		return nil
+	})
+	return err
+}
+
+// sessionExists はセッションが失効していないかどうか
+func sessionExists(ctx context.Context, sessionID string) (bool, error) {
+	n, err := redisClient.Exists(ctx, sessionRedisKeyPrefix+sessionID).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// revokeSessions はセッションを失効させる
+func revokeSessions(ctx context.Context, userID int64, sessionIDs ...string) error {
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(sessionIDs))
+	members := make([]interface{}, len(sessionIDs))
+	for i, sessionID := range sessionIDs {
+		keys[i] = sessionRedisKeyPrefix + sessionID
+		members[i] = sessionID
+	}
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, keys...)
+		pipe.ZRem(ctx, fmt.Sprintf("%s%d", userSessionsRedisKeyPrefix, userID), members...)
+		return nil
+	})
+	return err
+}
+
+// getUserSessions はユーザの有効なセッションをログインした順に返す
+func getUserSessions(ctx context.Context, userID int64) ([]SessionModel, error) {
+	key := fmt.Sprintf("%s%d", userSessionsRedisKeyPrefix, userID)
+	// 期限切れのものはついでに掃除する
+	if err := redisClient.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(time.Now().Unix(), 10)).Err(); err != nil {
+		return nil, err
+	}
+	sessionIDs, err := redisClient.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(sessionIDs) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(sessionIDs))
+	for i, sessionID := range sessionIDs {
+		keys[i] = sessionRedisKeyPrefix + sessionID
+	}
+	payloads, err := redisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var sessionModels []SessionModel
+	for _, payload := range payloads {
+		s, ok := payload.(string)
+		if !ok {
+			// 失効済み
+			continue
+		}
+		var sessionModel SessionModel
+		if err := json.Unmarshal([]byte(s), &sessionModel); err != nil {
+			return nil, err
+		}
+		sessionModels = append(sessionModels, sessionModel)
+	}
+	return sessionModels, nil
+}
+
+// clearSessionCookie はブラウザのCookieを消す
+func clearSessionCookie(c echo.Context) error {
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return err
+	}
+	sess.Options = &sessions.Options{
+		Domain: "u.isucon.dev",
+		MaxAge: -1,
+		Path:   "/",
+	}
+	sess.Values = map[interface{}]interface{}{}
+	return sess.Save(c.Request(), c.Response())
+}
+
+// ログアウト
+// POST /api/logout
+func logoutHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	sessionID, _ := sess.Values[defaultSessionIDKey].(string)
+
+	if err := revokeSessions(ctx, userID, sessionID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke session: "+err.Error())
+	}
+	if err := clearSessionCookie(c); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to clear session: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// すべての端末からログアウト
+// POST /api/logout/all
+func logoutAllHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if err := revokeAllUserSessions(ctx, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke sessions: "+err.Error())
+	}
+	if err := clearSessionCookie(c); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to clear session: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// revokeAllUserSessions はユーザのすべてのセッションを失効させる
+func revokeAllUserSessions(ctx context.Context, userID int64) error {
+	sessionIDs, err := redisClient.ZRange(ctx, fmt.Sprintf("%s%d", userSessionsRedisKeyPrefix, userID), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	return revokeSessions(ctx, userID, sessionIDs...)
+}
+
+// revokeOtherUserSessions はcurrentSessionID以外のユーザのセッションを失効させる
+func revokeOtherUserSessions(ctx context.Context, userID int64, currentSessionID string) error {
+	sessionIDs, err := redisClient.ZRange(ctx, fmt.Sprintf("%s%d", userSessionsRedisKeyPrefix, userID), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	sessionIDs = slices.DeleteFunc(sessionIDs, func(sessionID string) bool {
+		return sessionID == currentSessionID
+	})
+	return revokeSessions(ctx, userID, sessionIDs...)
+}
+
+// ログイン中のセッション一覧
+// GET /api/user/me/sessions
+func getSessionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	currentSessionID, _ := sess.Values[defaultSessionIDKey].(string)
+
+	sessionModels, err := getUserSessions(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get sessions: "+err.Error())
+	}
+
+	sessions := make([]Session, len(sessionModels))
+	for i, sessionModel := range sessionModels {
+		sessions[i] = Session{
+			ID:        sessionModel.ID,
+			UserAgent: sessionModel.UserAgent,
+			RemoteIP:  sessionModel.RemoteIP,
+			CreatedAt: sessionModel.CreatedAt,
+			ExpiresAt: sessionModel.ExpiresAt,
+			Current:   sessionModel.ID == currentSessionID,
+		}
+	}
+	return c.JSON(http.StatusOK, sessions)
+}
+
+// 特定のセッションを失効させる
+// DELETE /api/user/me/sessions/:session_id
+func deleteSessionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	sessionID := c.Param("session_id")
+	// 他人のセッションは消せない
+	if _, err := redisClient.ZScore(ctx, fmt.Sprintf("%s%d", userSessionsRedisKeyPrefix, userID), sessionID).Result(); err != nil {
+		if err == redis.Nil {
+			return echo.NewHTTPError(http.StatusNotFound, "session not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get session: "+err.Error())
+	}
+
+	if err := revokeSessions(ctx, userID, sessionID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to revoke session: "+err.Error())
+	}
+	return c.NoContent(http.StatusOK)
+}
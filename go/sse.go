@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// SSEのコネクションをnginxやLBに切られないよう、定期的にコメント行を送る
+const sseHeartbeatInterval = 15 * time.Second
+
+// startSSE はレスポンスを text/event-stream として開始する
+func startSSE(c echo.Context) {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	// nginxのproxy_bufferingを無効化する
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+}
+
+// writeSSEEvent はSSEのイベントを1件書き込む。idが空の場合はidフィールドを出力しない
+func writeSSEEvent(c echo.Context, id string, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	if id != "" {
+		fmt.Fprintf(&b, "id: %s\n", id)
+	}
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	fmt.Fprintf(&b, "data: %s\n\n", payload)
+
+	res := c.Response()
+	if _, err := res.Write([]byte(b.String())); err != nil {
+		return err
+	}
+	res.Flush()
+	return nil
+}
+
+// writeSSEHeartbeat はクライアントには無視されるコメント行を書き込む
+func writeSSEHeartbeat(c echo.Context) error {
+	res := c.Response()
+	if _, err := res.Write([]byte(": ping\n\n")); err != nil {
+		return err
+	}
+	res.Flush()
+	return nil
+}
+
+// lastEventID は再接続時のLast-Event-IDを取り出す。
+// EventSourceの初回接続ではヘッダを付けられないので、クエリパラメータも見る
+func lastEventID(c echo.Context) string {
+	if id := c.Request().Header.Get("Last-Event-ID"); id != "" {
+		return id
+	}
+	return c.QueryParam("last_event_id")
+}
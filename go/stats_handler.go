@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"sort"
 	"strconv"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 )
 
@@ -91,37 +93,22 @@ func getUserStatisticsHandler(c echo.Context) error {
 	}
 
 	// ランク算出
+	// コラボ配信のリアクション数とチップはホストで分け合う (splitAmongHosts)
+	credits, err := getUserCredits(ctx, tx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions and tips: "+err.Error())
+	}
+
 	var users []*UserModel
 	// FIXME: ここで全ユーザー引いてきてリーダーボード作ってるのやばすぎる
-	if err := tx.SelectContext(ctx, &users, "SELECT * FROM users"); err != nil {
+	if err := tx.SelectContext(ctx, &users, "SELECT * FROM users WHERE deleted_at = 0"); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
 	}
 
 	var ranking UserRanking
 	for _, user := range users {
-		var reactions int64
-		// FIXME: N+1
-		query := `
-		SELECT COUNT(*) FROM users u
-		INNER JOIN livestreams l ON l.user_id = u.id
-		INNER JOIN reactions r ON r.livestream_id = l.id
-		WHERE u.id = ?`
-		if err := tx.GetContext(ctx, &reactions, query, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
-		}
-
-		var tips int64
-		// FIXME: N+1
-		query = `
-		SELECT IFNULL(SUM(l2.tip), 0) FROM users u
-		INNER JOIN livestreams l ON l.user_id = u.id	
-		INNER JOIN livecomments l2 ON l2.livestream_id = l.id
-		WHERE u.id = ?`
-		if err := tx.GetContext(ctx, &tips, query, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
-		}
-
-		score := reactions + tips
+		credit := credits[user.ID]
+		score := credit.Reactions + credit.Tips
 		ranking = append(ranking, UserRankingEntry{
 			Username: user.Name,
 			Score:    score,
@@ -140,23 +127,15 @@ func getUserStatisticsHandler(c echo.Context) error {
 	}
 
 	// リアクション数
-	// FIXME: これもオンラインでやるのはヤバくね
-	var totalReactions int64
-	query := `SELECT COUNT(*) FROM users u 
-    INNER JOIN livestreams l ON l.user_id = u.id 
-    INNER JOIN reactions r ON r.livestream_id = l.id
-    WHERE u.name = ?
-	`
-	if err := tx.GetContext(ctx, &totalReactions, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
-	}
+	totalReactions := credits[user.ID].Reactions
 
 	// ライブコメント数、チップ合計
+	// ライブコメント数と視聴者数は、コラボ配信のものもホスト全員にそのまま計上する
 	var totalLivecomments int64
-	var totalTip int64
+	totalTip := credits[user.ID].Tips
 	var livestreams []*LivestreamModel
 	// FIXME: indexきいてるかどうかみてくれ
-	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams WHERE user_id = ? OR id IN (SELECT livestream_id FROM livestream_collaborators WHERE user_id = ?)", user.ID, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
@@ -169,10 +148,7 @@ func getUserStatisticsHandler(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 		}
 
-		for _, livecomment := range livecomments {
-			totalTip += livecomment.Tip
-			totalLivecomments++
-		}
+		totalLivecomments += int64(len(livecomments))
 	}
 
 	// 合計視聴者数
@@ -189,17 +165,16 @@ func getUserStatisticsHandler(c echo.Context) error {
 
 	// お気に入り絵文字
 	var favoriteEmoji string
-	query = `
+	query := `
 	SELECT r.emoji_name
-	FROM users u
-	INNER JOIN livestreams l ON l.user_id = u.id
+	FROM livestreams l
 	INNER JOIN reactions r ON r.livestream_id = l.id
-	WHERE u.name = ?
+	WHERE l.user_id = ? OR l.id IN (SELECT livestream_id FROM livestream_collaborators WHERE user_id = ?)
 	GROUP BY emoji_name
 	ORDER BY COUNT(*) DESC, emoji_name DESC
 	LIMIT 1
 	`
-	if err := tx.GetContext(ctx, &favoriteEmoji, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err := tx.GetContext(ctx, &favoriteEmoji, query, user.ID, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
 	}
 
@@ -214,6 +189,59 @@ func getUserStatisticsHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, stats)
 }
 
+// userCredit はユーザ別統計に計上するリアクション数とチップ合計
+type userCredit struct {
+	Reactions int64
+	Tips      int64
+}
+
+// getUserCredits は配信ごとのリアクション数とチップ合計を、配信のホストに割り振ってユーザごとに集計する
+func getUserCredits(ctx context.Context, tx *sqlx.Tx) (map[int64]userCredit, error) {
+	var livestreamTotals []struct {
+		LivestreamID int64 `db:"id"`
+		UserID       int64 `db:"user_id"`
+		Reactions    int64 `db:"reactions"`
+		Tips         int64 `db:"tips"`
+	}
+	// FIXME: これをオンラインで集計するのやばそう
+	query := `
+	SELECT l.id, l.user_id,
+	(SELECT COUNT(*) FROM reactions r WHERE r.livestream_id = l.id) AS reactions,
+	(SELECT IFNULL(SUM(l2.tip), 0) FROM livecomments l2 WHERE l2.livestream_id = l.id) AS tips
+	FROM livestreams l`
+	if err := tx.SelectContext(ctx, &livestreamTotals, query); err != nil {
+		return nil, err
+	}
+
+	var collaborators []*LivestreamCollaboratorModel
+	if err := tx.SelectContext(ctx, &collaborators, "SELECT * FROM livestream_collaborators"); err != nil {
+		return nil, err
+	}
+	livestreamID2CollaboratorIDs := make(map[int64][]int64)
+	for _, collaborator := range collaborators {
+		livestreamID2CollaboratorIDs[collaborator.LivestreamID] = append(livestreamID2CollaboratorIDs[collaborator.LivestreamID], collaborator.UserID)
+	}
+
+	credits := make(map[int64]userCredit)
+	for _, total := range livestreamTotals {
+		collaboratorIDs := livestreamID2CollaboratorIDs[total.LivestreamID]
+		hosts := int64(len(collaboratorIDs) + 1)
+
+		credit := credits[total.UserID]
+		credit.Reactions += splitAmongHosts(total.Reactions, hosts, true)
+		credit.Tips += splitAmongHosts(total.Tips, hosts, true)
+		credits[total.UserID] = credit
+
+		for _, userID := range collaboratorIDs {
+			credit := credits[userID]
+			credit.Reactions += splitAmongHosts(total.Reactions, hosts, false)
+			credit.Tips += splitAmongHosts(total.Tips, hosts, false)
+			credits[userID] = credit
+		}
+	}
+	return credits, nil
+}
+
 func getLivestreamStatisticsHandler(c echo.Context) error {
 	// FIXME: これも全体的にヤバい
 
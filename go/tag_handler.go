@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+type PostTagRequest struct {
+	Name string `json:"name"`
+}
+
+type MergeTagRequest struct {
+	// 統合先のタグ
+	IntoTagID int64 `json:"into_tag_id"`
+}
+
+// AdminTag は管理APIで返すタグ。廃止済みのタグも含む
+type AdminTag struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// 廃止されていなければ0
+	DeprecatedAt int64 `json:"deprecated_at"`
+}
+
+// refreshTagsCache は tags, tag_id2name:, name2tag_id: をDBの内容で置き換える。
+// staleNames は改名や統合で使われなくなったタグ名で、統合先があればそのIDを、なければ0を指定する。
+// 廃止されたタグは一覧には出さないが、既存の配信の表示と検索のためにIDと名前の対応は残す。
+// ロールバックされた変更をキャッシュに残さないよう、コミットした後にdbConnを渡して呼ぶこと
+func refreshTagsCache(ctx context.Context, db sqlx.QueryerContext, staleNames map[string]int64, staleIDs []int64) error {
+	var tagModels []*TagModel
+	if err := sqlx.SelectContext(ctx, db, &tagModels, "SELECT * FROM tags ORDER BY id"); err != nil {
+		return err
+	}
+
+	tagsCacheItems := make([]interface{}, 0, len(tagModels))
+	tagID2NameCacheItems := make([]interface{}, 0, len(tagModels)*2)
+	name2tagIDCacheItems := make([]interface{}, 0, len(tagModels)*2)
+	for _, tag := range tagModels {
+		tagID2NameCacheItems = append(tagID2NameCacheItems, fmt.Sprintf("%s%d", TagID2NameCacheRedisKeyPrefix, tag.ID), tag.Name)
+		name2tagIDCacheItems = append(name2tagIDCacheItems, Name2TagIDCacheRedisKeyPrefix+tag.Name, strconv.FormatInt(tag.ID, 10))
+		if tag.DeprecatedAt == 0 {
+			tagsCacheItems = append(tagsCacheItems, fmt.Sprintf("%d:%s", tag.ID, tag.Name))
+		}
+	}
+
+	// 一覧を消してから積み直すので、初期化が2回走っても重複しない
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, tagsCacheRedisKey)
+		if len(tagsCacheItems) > 0 {
+			pipe.LPush(ctx, tagsCacheRedisKey, tagsCacheItems...)
+		}
+		for name, intoTagID := range staleNames {
+			if intoTagID > 0 {
+				pipe.Set(ctx, Name2TagIDCacheRedisKeyPrefix+name, strconv.FormatInt(intoTagID, 10), 0)
+			} else {
+				pipe.Del(ctx, Name2TagIDCacheRedisKeyPrefix+name)
+			}
+		}
+		for _, tagID := range staleIDs {
+			pipe.Del(ctx, fmt.Sprintf("%s%d", TagID2NameCacheRedisKeyPrefix, tagID))
+		}
+		if len(tagID2NameCacheItems) > 0 {
+			pipe.MSet(ctx, tagID2NameCacheItems...)
+			pipe.MSet(ctx, name2tagIDCacheItems...)
+		}
+		return nil
+	})
+	return err
+}
+
+// タグ一覧 (廃止済みを含む)
+// GET /api/admin/tags
+func getAdminTagsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdmin(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var tagModels []*TagModel
+	if err := dbConn.SelectContext(ctx, &tagModels, "SELECT * FROM tags ORDER BY id"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+	}
+
+	tags := make([]AdminTag, len(tagModels))
+	for i, tagModel := range tagModels {
+		tags[i] = adminTagResponse(*tagModel)
+	}
+	return c.JSON(http.StatusOK, tags)
+}
+
+// タグの追加
+// POST /api/admin/tags
+func postTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	req := PostTagRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := verifyTagName(req.Name); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if err := verifyTagNameNotTaken(ctx, tx, req.Name); err != nil {
+		return err
+	}
+
+	rs, err := tx.ExecContext(ctx, "INSERT INTO tags (name) VALUES (?)", req.Name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag: "+err.Error())
+	}
+	tagID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted tag id: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if err := refreshTagsCache(ctx, dbConn, nil, nil); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag cache: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, AdminTag{
+		ID:   tagID,
+		Name: req.Name,
+	})
+}
+
+// タグの改名
+// PATCH /api/admin/tags/:tag_id
+func renameTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	req := PostTagRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := verifyTagName(req.Name); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	tagModel, err := lockTag(ctx, tx, tagID)
+	if err != nil {
+		return err
+	}
+	if tagModel.Name == req.Name {
+		return c.JSON(http.StatusOK, adminTagResponse(tagModel))
+	}
+	if err := verifyTagNameNotTaken(ctx, tx, req.Name); err != nil {
+		return err
+	}
+
+	oldName := tagModel.Name
+	tagModel.Name = req.Name
+	if _, err := tx.ExecContext(ctx, "UPDATE tags SET name = ? WHERE id = ?", tagModel.Name, tagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if err := refreshTagsCache(ctx, dbConn, map[string]int64{oldName: 0}, nil); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag cache: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, adminTagResponse(tagModel))
+}
+
+// タグの統合。統合元のタグが付いた配信は統合先のタグに付け替え、統合元は削除する。
+// 統合元のタグ名で検索すると統合先のタグの配信が出る
+// POST /api/admin/tags/:tag_id/merge
+func mergeTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	req := MergeTagRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.IntoTagID == tagID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't merge a tag into itself")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	sourceTag, err := lockTag(ctx, tx, tagID)
+	if err != nil {
+		return err
+	}
+	intoTag, err := lockTag(ctx, tx, req.IntoTagID)
+	if err != nil {
+		return err
+	}
+
+	var livestreamIDs []int64
+	if err := tx.SelectContext(ctx, &livestreamIDs, "SELECT livestream_id FROM livestream_tags WHERE tag_id = ?", sourceTag.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
+	}
+
+	// 両方のタグが付いている配信は統合元の方を消すだけでよい
+	if _, err := tx.ExecContext(ctx, "DELETE lt FROM livestream_tags lt INNER JOIN livestream_tags lt2 ON lt2.livestream_id = lt.livestream_id AND lt2.tag_id = ? WHERE lt.tag_id = ?", intoTag.ID, sourceTag.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE livestream_tags SET tag_id = ? WHERE tag_id = ?", intoTag.ID, sourceTag.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream tags: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", sourceTag.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// キャッシュはコミットした内容で作り直す
+	for _, livestreamID := range livestreamIDs {
+		// FIXME: N+1
+		var tagIDs []int64
+		if err := dbConn.SelectContext(ctx, &tagIDs, "SELECT tag_id FROM livestream_tags WHERE livestream_id = ? ORDER BY id", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
+		}
+		if err := cacheLivestreamTags(ctx, livestreamID, tagIDs); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream tag cache: "+err.Error())
+		}
+	}
+
+	if err := refreshTagsCache(ctx, dbConn, map[string]int64{sourceTag.Name: intoTag.ID}, []int64{sourceTag.ID}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag cache: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, adminTagResponse(intoTag))
+}
+
+// タグの廃止。一覧に出なくなり、新しく配信に付けられなくなる。すでに付いている配信はそのまま
+// POST /api/admin/tags/:tag_id/deprecate
+func deprecateTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdmin(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.ParseInt(c.Param("tag_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	tagModel, err := lockTag(ctx, tx, tagID)
+	if err != nil {
+		return err
+	}
+	if tagModel.DeprecatedAt > 0 {
+		return c.JSON(http.StatusOK, adminTagResponse(tagModel))
+	}
+
+	tagModel.DeprecatedAt = time.Now().Unix()
+	if _, err := tx.ExecContext(ctx, "UPDATE tags SET deprecated_at = ? WHERE id = ?", tagModel.DeprecatedAt, tagModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if err := refreshTagsCache(ctx, dbConn, nil, nil); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tag cache: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, adminTagResponse(tagModel))
+}
+
+func lockTag(ctx context.Context, tx *sqlx.Tx, tagID int64) (TagModel, error) {
+	var tagModel TagModel
+	if err := tx.GetContext(ctx, &tagModel, "SELECT * FROM tags WHERE id = ? FOR UPDATE", tagID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return TagModel{}, echo.NewHTTPError(http.StatusNotFound, "tag not found")
+		}
+		return TagModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+	}
+	return tagModel, nil
+}
+
+// verifyTagName はタグ名をチェックする。tags のキャッシュは "id:name" 形式なので ':' は使えない
+func verifyTagName(name string) error {
+	if name == "" || len(name) > 255 {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag name must be 1 to 255 bytes")
+	}
+	if strings.Contains(name, ":") {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag name must not contain ':'")
+	}
+	return nil
+}
+
+func verifyTagNameNotTaken(ctx context.Context, tx *sqlx.Tx, name string) error {
+	var found int
+	err := tx.GetContext(ctx, &found, "SELECT 1 FROM tags WHERE name = ? FOR UPDATE", name)
+	if err == nil {
+		return echo.NewHTTPError(http.StatusConflict, "tag name already exists")
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+	}
+	return nil
+}
+
+func adminTagResponse(tagModel TagModel) AdminTag {
+	return AdminTag{
+		ID:           tagModel.ID,
+		Name:         tagModel.Name,
+		DeprecatedAt: tagModel.DeprecatedAt,
+	}
+}
@@ -18,6 +18,8 @@ type Tag struct {
 type TagModel struct {
 	ID   int64  `db:"id"`
 	Name string `db:"name"`
+	// 廃止されていなければ0
+	DeprecatedAt int64 `db:"deprecated_at"`
 }
 
 type TagsResponse struct {
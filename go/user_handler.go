@@ -2,18 +2,14 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
-	"os/exec"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -33,6 +29,9 @@ const (
 	bcryptDefaultCost        = bcrypt.MinCost
 )
 
+// パスワードをハッシュ化するときのコスト。これより低いコストのハッシュはログイン時に作り直す
+var bcryptCost = bcryptDefaultCost
+
 var fallbackImage = "../img/NoImage.jpg"
 
 type UserModel struct {
@@ -41,6 +40,12 @@ type UserModel struct {
 	DisplayName    string `db:"display_name"`
 	Description    string `db:"description"`
 	HashedPassword string `db:"password"`
+	// 退会を受け付けた時刻。0なら退会していない
+	DeletedAt int64 `db:"deleted_at"`
+	// 個人データを消した時刻
+	PurgedAt int64 `db:"purged_at"`
+	// 選んでいるアイコン。0なら一番新しいアイコン
+	IconID int64 `db:"icon_id"`
 }
 
 type User struct {
@@ -50,6 +55,10 @@ type User struct {
 	Description string `json:"description,omitempty"`
 	Theme       Theme  `json:"theme,omitempty"`
 	IconHash    string `json:"icon_hash,omitempty"`
+	// フォローされている人数
+	FollowerCount int64 `json:"follower_count"`
+	// フォローしている人数
+	FollowingCount int64 `json:"following_count"`
 }
 
 type Theme struct {
@@ -86,6 +95,15 @@ type PostIconRequest struct {
 	Image []byte `json:"image"`
 }
 
+type IconModel struct {
+	ID     int64  `db:"id"`
+	UserID int64  `db:"user_id"`
+	Hash   string `db:"hash"`
+	// アップロード時に揃えた画像の形式
+	ContentType string `db:"content_type"`
+	CreatedAt   int64  `db:"created_at"`
+}
+
 type PostIconResponse struct {
 	ID int64 `json:"id"`
 }
@@ -95,6 +113,11 @@ func getIconHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
+	size, err := parseIconSize(c)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil) // FIXME: ここもselectのみのtxnっぽい
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -110,22 +133,50 @@ func getIconHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	var image []byte
-	// FIXME: index効いてる？
-	// FIXME: DBにアイコンが入ってる
-	if err := tx.GetContext(ctx, &image, "SELECT image FROM icons WHERE user_id = ?", user.ID); err != nil {
+	icon, err := getUserIcon(ctx, tx, user)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if icon == nil {
+		return serveIcon(c, fallbackIconHash, size, "", mutableIconCacheControl)
+	}
+	return serveIcon(c, icon.Hash, size, icon.ContentType, mutableIconCacheControl)
+}
+
+// ハッシュで指定したアイコン。中身が変わらないのでずっとキャッシュできる
+// GET /api/icon/:hash
+func getIconByHashHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	hash := c.Param("hash")
+
+	size, err := parseIconSize(c)
+	if err != nil {
+		return err
+	}
+
+	if hash == fallbackIconHash {
+		return serveIcon(c, fallbackIconHash, size, "", immutableIconCacheControl)
+	}
+
+	var icon IconModel
+	if err := dbConn.GetContext(ctx, &icon, "SELECT * FROM icons WHERE hash = ? LIMIT 1", hash); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return c.File(fallbackImage)
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error())
+			return echo.NewHTTPError(http.StatusNotFound, "not found icon that has the given hash")
 		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon: "+err.Error())
 	}
 
-	return c.Blob(http.StatusOK, "image/jpeg", image)
+	return serveIcon(c, icon.Hash, size, icon.ContentType, immutableIconCacheControl)
 }
 
 func postIconHandler(c echo.Context) error {
-	//ctx := c.Request().Context()
+	ctx := c.Request().Context()
 
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
@@ -142,40 +193,69 @@ func postIconHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
+	// 画像でないものは保存しない
+	icon, err := normalizeIcon(req.Image)
+	if errors.Is(err, errInvalidIcon) {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to normalize icon: "+err.Error())
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
 	// ユーザー名を引っ張ってくる
 	userModel := UserModel{}
-	stmt, err := dbConn.Preparex("SELECT * FROM users WHERE id = ?")
-	if err != nil {
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	if err := stmt.Get(&userModel, userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	// 履歴にある画像と同じなら、その画像を選び直す
+	var id int64
+	err = tx.GetContext(ctx, &id, "SELECT id FROM icons WHERE user_id = ? AND hash = ? LIMIT 1", userModel.ID, icon.Hash())
+	if errors.Is(err, sql.ErrNoRows) {
+		// hashをinsertする
+		res, err := tx.ExecContext(ctx, "INSERT INTO icons (user_id, hash, content_type, created_at) VALUES (?, ?, ?, ?)", userModel.ID, icon.Hash(), icon.ContentType, time.Now().Unix())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert icon: "+err.Error())
+		}
+
+		id, err = res.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted icon id: "+err.Error())
+		}
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon: "+err.Error())
 	}
 
 	// ファイルを書き込む
-	filename := "/home/isucon/webapp/icons/" + userModel.Name
+	// ハッシュで名前を付けているので、以前のアイコンは上書きされずに残る。
+	// 行を入れてから書くことで、同じ画像を消している deleteIcons がいればそのコミットを待ってから書き、
+	// 後から来た deleteIcons にはこの行が見えるので画像を消されない
+	if err := saveIconFiles(ctx, icon); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to write icon: "+err.Error())
+	}
 
-	err = ioutil.WriteFile(filename, req.Image, 0644)
-	if err != nil {
-		log.Fatalf("Failed to write to icon file: %v", err)
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET icon_id = ? WHERE id = ?", id, userModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to select icon: "+err.Error())
 	}
-	// hashをinsertする
-	stmt, err = dbConn.Preparex("INSERT INTO icons (user_id, hash) VALUES (?, ?)")
+
+	// 履歴が多すぎれば古いものから消す
+	orphanHashes, err := trimIconHistory(ctx, tx, userModel.ID, id)
 	if err != nil {
-		c.Logger().Printf("failed to insert prepare icon: "+err.Error()+"\n", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to trim icon history: "+err.Error())
 	}
 
-	hash := sha256.Sum256(req.Image)
-
-	res, err := stmt.Exec(userModel.ID, fmt.Sprintf("%x", hash))
-	if err != nil {
-		c.Logger().Printf("failed to insert exec icon: "+err.Error()+"\n", err)
+	if err := removeIconFiles(ctx, "", orphanHashes); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to remove icon: "+err.Error())
 	}
 
-	id, err := res.LastInsertId()
-	if err != nil {
-		log.Fatalln(err)
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
 	return c.JSON(http.StatusCreated, &PostIconResponse{
@@ -237,8 +317,11 @@ func registerHandler(c echo.Context) error {
 	if req.Name == "pipe" {
 		return echo.NewHTTPError(http.StatusBadRequest, "the username 'pipe' is reserved")
 	}
+	if strings.HasPrefix(req.Name, deletedUserNamePrefix) {
+		return echo.NewHTTPError(http.StatusBadRequest, "usernames starting with '"+deletedUserNamePrefix+"' are reserved")
+	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptDefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptCost)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
 	}
@@ -276,41 +359,31 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user theme: "+err.Error())
 	}
 
-	if out, err := exec.Command("pdnsutil", "add-record", "u.isucon.dev", req.Name, "A", "0", powerDNSSubdomainAddress).CombinedOutput(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, string(out)+": "+err.Error())
+	// サブドメインが作れなければユーザも作らない
+	if err := addSubdomainRecord(ctx, req.Name); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to add subdomain record: "+err.Error())
 	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		// ユーザが作れなかったので、追加したサブドメインを戻す。
+		// クライアントが切断していても戻せるよう、キャンセルされないcontextを使う
+		if err := deleteSubdomainRecord(context.WithoutCancel(ctx), req.Name); err != nil {
+			log.Printf("failed to delete subdomain record of unregistered user %s: %+v", req.Name, err)
+		}
+	}()
 
 	user, err := fillUserResponse(ctx, tx, userModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
 	}
 
-	// 標準のNoImageからファイルをコピーする
-	srcFile, err := os.Open("/home/isucon/webapp/public/NoImage.jpg")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer srcFile.Close()
-
-	destFile, err := os.Create("/home/isucon/webapp/icons/" + userModel.Name)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer destFile.Close()
-
-	_, err = io.Copy(destFile, srcFile)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to copy Default Image: "+err.Error())
-	}
-
-	err = destFile.Sync()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to copy sync Default Image: "+err.Error())
-	}
-
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	committed = true
 
 	redisClient.ZAdd(ctx, UserLeaderBoardRedisKey, redis.Z{
 		Score:  0,
@@ -331,6 +404,17 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
+	// 総当たり対策として、失敗が続いているユーザ名・IPアドレスからのログインはbcryptする前に断る
+	remoteIP := c.RealIP()
+	allowed, retryAfter, err := beginLoginAttempt(ctx, req.Username, remoteIP)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to record login attempt: "+err.Error())
+	}
+	if !allowed {
+		c.Response().Header().Set(echo.HeaderRetryAfter, retryAfterSeconds(retryAfter))
+		return echo.NewHTTPError(http.StatusTooManyRequests, "too many failed login attempts")
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil) // FIXME: selectのみtxn
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -341,8 +425,9 @@ func loginHandler(c echo.Context) error {
 	// usernameはUNIQUEなので、whereで一意に特定できる
 	// FIXME: index効いてるかどうかみてくれ
 	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", req.Username)
-	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+	if errors.Is(err, sql.ErrNoRows) || userModel.DeletedAt > 0 {
+		// 存在しないユーザ名も同じように数えて、ユーザの存在を推測させない
+		return loginFailed(c, retryAfter)
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
@@ -355,16 +440,38 @@ func loginHandler(c echo.Context) error {
 	// FIXME: 暗号化解いてもいいよ
 	err = bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(req.Password))
 	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+		return loginFailed(c, retryAfter)
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
 	}
 
-	sessionEndAt := time.Now().Add(1 * time.Hour)
+	if err := loginSucceeded(ctx, req.Username, remoteIP); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reset login attempts: "+err.Error())
+	}
+
+	// 設定より低いコストでハッシュ化されていれば、平文が手元にあるうちに作り直す
+	if err := rehashPasswordIfNeeded(ctx, userModel, req.Password); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to rehash password: "+err.Error())
+	}
+
+	now := time.Now()
+	sessionEndAt := now.Add(sessionLifetime)
 
 	sessionID := uuid.NewString()
 
+	if err := saveSession(ctx, SessionModel{
+		ID:        sessionID,
+		UserID:    userModel.ID,
+		Username:  userModel.Name,
+		UserAgent: c.Request().UserAgent(),
+		RemoteIP:  c.RealIP(),
+		CreatedAt: now.Unix(),
+		ExpiresAt: sessionEndAt.Unix(),
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	}
+
 	sess, err := session.Get(defaultSessionIDKey, c)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
@@ -407,7 +514,7 @@ func getUserHandler(c echo.Context) error {
 
 	userModel := UserModel{}
 	// FIXME: indexきいてるかどうかみてくれ
-	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", username); err != nil {
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ? AND deleted_at = 0", username); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
 		}
@@ -426,7 +533,39 @@ func getUserHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
+// loginFailed は401を返す。試行は beginLoginAttempt で失敗として数えてある
+func loginFailed(c echo.Context, retryAfter time.Duration) error {
+	// 次に試せるようになるまでの時間を教えておく
+	if retryAfter > 0 {
+		c.Response().Header().Set(echo.HeaderRetryAfter, retryAfterSeconds(retryAfter))
+	}
+	return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+}
+
+func rehashPasswordIfNeeded(ctx context.Context, userModel UserModel, password string) error {
+	cost, err := bcrypt.Cost([]byte(userModel.HashedPassword))
+	if err != nil {
+		return err
+	}
+	if cost >= bcryptCost {
+		return nil
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return err
+	}
+	// 同時にパスワードが変更されていたら上書きしない
+	_, err = dbConn.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ? AND password = ?", hashedPassword, userModel.ID, userModel.HashedPassword)
+	return err
+}
+
 func verifyUserSession(c echo.Context) error {
+	// APIトークンはapiTokenMiddlewareで検証済み
+	if c.Get(apiTokenIDContextKey) != nil {
+		return nil
+	}
+
 	sess, err := session.Get(defaultSessionIDKey, c)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
@@ -447,24 +586,68 @@ func verifyUserSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
 	}
 
+	// ログアウトなどで失効したセッションはCookieが残っていても通さない
+	sessionID, _ := sess.Values[defaultSessionIDKey].(string)
+	exists, err := sessionExists(c.Request().Context(), sessionID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get session: "+err.Error())
+	}
+	if !exists {
+		return echo.NewHTTPError(http.StatusUnauthorized, "session has been revoked")
+	}
+
+	return nil
+}
+
+// verifyAdmin はセッションのユーザが管理者かをチェックする。
+// 管理者は ISUCON13_ADMIN_USERNAMES にカンマ区切りで指定する
+func verifyAdmin(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	username, ok := sess.Values[defaultUsernameKey].(string)
+	if !ok || !adminUsernames[username] {
+		return echo.NewHTTPError(http.StatusForbidden, "only administrators can use this API")
+	}
+
 	return nil
 }
 
 // FIXME: userをfillするときに必ず2クエリ発行されるのでなんとかせよ
 func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
+	if userModel.DeletedAt > 0 {
+		// 退会したユーザのライブコメントやリアクションは、猶予期間中でも誰のものか分からないようにして返す
+		return User{
+			ID:       userModel.ID,
+			Name:     fmt.Sprintf(deletedUserNameFormat, userModel.ID),
+			IconHash: fallbackIconHash,
+		}, nil
+	}
+
 	themeModel := ThemeModel{}
 	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ?", userModel.ID); err != nil {
 		return User{}, err
 	}
 
-	var hash string
-	if err := tx.GetContext(ctx, &hash, "SELECT hash FROM icons WHERE user_id = ? ORDER BY ID DESC limit 1 ", userModel.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			hash = "d9f8294e9d895f81ce62e73dc7d5dff862a4fa40bd4e0fecf53f7526a8edcac0"
-		}
+	// getIconHandler が返す画像と同じもののハッシュを返す
+	hash := fallbackIconHash
+	iconModel, err := getUserIcon(ctx, tx, userModel)
+	if err != nil {
+		return User{}, err
+	}
+	if iconModel != nil {
+		hash = iconModel.Hash
 	}
 	// FIXED: hashは必要である、毎度計算するな。アップロード時にuserのレコードかなんかに入れとけ
 
+	followerCount, followingCount, err := getFollowCounts(ctx, userModel.ID)
+	if err != nil {
+		return User{}, err
+	}
+
 	user := User{
 		ID:          userModel.ID,
 		Name:        userModel.Name,
@@ -474,7 +657,9 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 			ID:       themeModel.ID,
 			DarkMode: themeModel.DarkMode,
 		},
-		IconHash: hash,
+		IconHash:       hash,
+		FollowerCount:  followerCount,
+		FollowingCount: followingCount,
 	}
 
 	return user, nil
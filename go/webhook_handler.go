@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// Webhookで送るイベントの種類
+const (
+	webhookEventLivecommentPosted  = "livecomment.posted"
+	webhookEventTipReceived        = "tip.received"
+	webhookEventReactionBurst      = "reaction.burst"
+	webhookEventReportFiled        = "report.filed"
+	webhookEventLivestreamReserved = "livestream.reserved"
+)
+
+var webhookEvents = []string{
+	webhookEventLivecommentPosted,
+	webhookEventTipReceived,
+	webhookEventReactionBurst,
+	webhookEventReportFiled,
+	webhookEventLivestreamReserved,
+}
+
+// ライブストリームのIDと時間枠をappendして使うこと
+const reactionBurstCounterRedisKeyPrefix = "reaction_burst:"
+
+// reactionBurstWindow 秒の間に reactionBurstThreshold 件のリアクションが来たら reaction.burst を送る
+const (
+	reactionBurstWindow    = 10
+	reactionBurstThreshold = 50
+)
+
+// 1ユーザが登録できるWebhookの上限
+const maxWebhooksPerUser = 10
+
+type WebhookModel struct {
+	ID     int64  `db:"id"`
+	UserID int64  `db:"user_id"`
+	URL    string `db:"url"`
+	// 署名に使う共有鍵
+	Secret string `db:"secret"`
+	// 送るイベントをカンマ区切りで並べたもの
+	Events    string `db:"events"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type Webhook struct {
+	ID        int64    `json:"id"`
+	URL       string   `json:"url"`
+	Secret    string   `json:"secret"`
+	Events    []string `json:"events"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+type PostWebhookRequest struct {
+	URL string `json:"url"`
+	// 空ならすべてのイベント
+	Events []string `json:"events"`
+}
+
+// WebhookPayload は受信側に送るJSON
+type WebhookPayload struct {
+	Event     string      `json:"event"`
+	CreatedAt int64       `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// ReactionBurstData はリアクションが短時間に集中したときのイベントの中身
+type ReactionBurstData struct {
+	LivestreamID int64 `json:"livestream_id"`
+	// reactionBurstWindow 秒あたりのリアクション数
+	Reactions int64 `json:"reactions"`
+	WindowSec int64 `json:"window_sec"`
+}
+
+// Webhookの登録
+// POST /api/webhooks
+func postWebhookHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	req := PostWebhookRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "url must be an absolute http or https url")
+	}
+	// アプリケーションサーバから内部のネットワークに送らせない
+	if err := verifyWebhookHost(ctx, u.Hostname()); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	events := req.Events
+	if len(events) == 0 {
+		events = webhookEvents
+	}
+	for _, event := range events {
+		if !slices.Contains(webhookEvents, event) {
+			return echo.NewHTTPError(http.StatusBadRequest, "unknown webhook event: "+event)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate webhook secret: "+err.Error())
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM webhooks WHERE user_id = ? FOR UPDATE", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count webhooks: "+err.Error())
+	}
+	if count >= maxWebhooksPerUser {
+		return echo.NewHTTPError(http.StatusBadRequest, "a user can register at most "+strconv.Itoa(maxWebhooksPerUser)+" webhooks")
+	}
+
+	webhookModel := WebhookModel{
+		UserID:    userID,
+		URL:       req.URL,
+		Secret:    hex.EncodeToString(secret),
+		Events:    strings.Join(events, ","),
+		CreatedAt: time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO webhooks (user_id, url, secret, events, created_at) VALUES (:user_id, :url, :secret, :events, :created_at)", webhookModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert webhook: "+err.Error())
+	}
+	webhookID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted webhook id: "+err.Error())
+	}
+	webhookModel.ID = webhookID
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, webhookResponse(webhookModel))
+}
+
+// 登録したWebhookの一覧
+// GET /api/webhooks
+func getWebhooksHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var webhookModels []WebhookModel
+	if err := dbConn.SelectContext(ctx, &webhookModels, "SELECT * FROM webhooks WHERE user_id = ? ORDER BY id", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get webhooks: "+err.Error())
+	}
+
+	webhooks := make([]Webhook, len(webhookModels))
+	for i := range webhookModels {
+		webhooks[i] = webhookResponse(webhookModels[i])
+	}
+	return c.JSON(http.StatusOK, webhooks)
+}
+
+// Webhookの削除。未送信のものは送らない
+// DELETE /api/webhooks/:webhook_id
+func deleteWebhookHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	webhookID, err := strconv.ParseInt(c.Param("webhook_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "webhook_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := getOwnedWebhook(ctx, tx, webhookID, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhooks WHERE id = ?", webhookID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete webhook: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE webhook_deliveries SET status = ?, last_error = ? WHERE webhook_id = ? AND status = ?", webhookDeliveryFailed, "webhook deleted", webhookID, webhookDeliveryPending); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to cancel webhook deliveries: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// Webhookの送信履歴
+// GET /api/webhooks/:webhook_id/deliveries
+func getWebhookDeliveriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	webhookID, err := strconv.ParseInt(c.Param("webhook_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "webhook_id in path must be integer")
+	}
+
+	page, err := parsePagination(c, 1)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil) // FIXME: selectのみのtxn
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := getOwnedWebhook(ctx, tx, webhookID, userID); err != nil {
+		return err
+	}
+
+	var deliveryModels []WebhookDeliveryModel
+	query, params := page.Apply("SELECT * FROM webhook_deliveries WHERE webhook_id = ?", []interface{}{webhookID}, "id")
+	if err := tx.SelectContext(ctx, &deliveryModels, query, params...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get webhook deliveries: "+err.Error())
+	}
+	if page.Forward() {
+		slices.Reverse(deliveryModels)
+	}
+	var next pageCursor
+	if page.HasNext(len(deliveryModels)) {
+		last := deliveryModels[len(deliveryModels)-1]
+		if page.Forward() {
+			last = deliveryModels[0]
+		}
+		next = pageCursor{last.ID}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	deliveries := make([]WebhookDelivery, len(deliveryModels))
+	for i := range deliveryModels {
+		deliveries[i] = webhookDeliveryResponse(deliveryModels[i])
+	}
+	return c.JSON(http.StatusOK, newPageResponse(deliveries, next))
+}
+
+func getOwnedWebhook(ctx context.Context, tx *sqlx.Tx, webhookID int64, userID int64) (WebhookModel, error) {
+	var webhookModel WebhookModel
+	if err := tx.GetContext(ctx, &webhookModel, "SELECT * FROM webhooks WHERE id = ?", webhookID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return WebhookModel{}, echo.NewHTTPError(http.StatusNotFound, "webhook not found")
+		}
+		return WebhookModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get webhook: "+err.Error())
+	}
+	if webhookModel.UserID != userID {
+		return WebhookModel{}, echo.NewHTTPError(http.StatusNotFound, "webhook not found")
+	}
+	return webhookModel, nil
+}
+
+// enqueueWebhookEvent は配信者が登録したWebhookのうち、eventを受け取るものに送信を積む。
+// 実際の送信はrunWebhookWorkerが行う
+func enqueueWebhookEvent(ctx context.Context, streamerID int64, event string, data interface{}) error {
+	var webhookModels []WebhookModel
+	if err := dbConn.SelectContext(ctx, &webhookModels, "SELECT * FROM webhooks WHERE user_id = ?", streamerID); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	var deliveryModels []WebhookDeliveryModel
+	for _, webhookModel := range webhookModels {
+		if !slices.Contains(strings.Split(webhookModel.Events, ","), event) {
+			continue
+		}
+		payload, err := json.Marshal(WebhookPayload{
+			Event:     event,
+			CreatedAt: now,
+			Data:      data,
+		})
+		if err != nil {
+			return err
+		}
+		deliveryModels = append(deliveryModels, WebhookDeliveryModel{
+			WebhookID:     webhookModel.ID,
+			Event:         event,
+			Payload:       string(payload),
+			Status:        webhookDeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		})
+	}
+	if len(deliveryModels) == 0 {
+		return nil
+	}
+
+	query := "INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at) VALUES (:webhook_id, :event, :payload, :status, :next_attempt_at, :created_at)"
+	if _, err := dbConn.NamedExecContext(ctx, query, deliveryModels); err != nil {
+		return err
+	}
+	return nil
+}
+
+// enqueueReactionBurstWebhook はリアクション数が閾値に達した瞬間に一度だけreaction.burstを積む
+func enqueueReactionBurstWebhook(ctx context.Context, livestreamModel LivestreamModel) error {
+	now := time.Now().Unix()
+	key := fmt.Sprintf("%s%d:%d", reactionBurstCounterRedisKeyPrefix, livestreamModel.ID, now/reactionBurstWindow)
+	count, err := redisClient.Incr(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	if count == 1 {
+		if err := redisClient.Expire(ctx, key, 2*reactionBurstWindow*time.Second).Err(); err != nil {
+			return err
+		}
+	}
+	if count != reactionBurstThreshold {
+		return nil
+	}
+
+	return enqueueWebhookEvent(ctx, livestreamModel.UserID, webhookEventReactionBurst, ReactionBurstData{
+		LivestreamID: livestreamModel.ID,
+		Reactions:    count,
+		WindowSec:    reactionBurstWindow,
+	})
+}
+
+func webhookResponse(webhookModel WebhookModel) Webhook {
+	return Webhook{
+		ID:        webhookModel.ID,
+		URL:       webhookModel.URL,
+		Secret:    webhookModel.Secret,
+		Events:    strings.Split(webhookModel.Events, ","),
+		CreatedAt: webhookModel.CreatedAt,
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// 送信の状態
+const (
+	webhookDeliveryPending   = "pending"
+	webhookDeliverySucceeded = "succeeded"
+	webhookDeliveryFailed    = "failed"
+)
+
+const (
+	// この間隔ごとに送信待ちのWebhookを探す
+	webhookWorkerInterval = 1 * time.Second
+	// 1回に取り出す送信の数
+	webhookWorkerBatchSize = 20
+	// 受信側の応答を待つ時間。取り出した送信はこの間ほかのワーカーから見えなくする
+	webhookDeliveryTimeout = 5 * time.Second
+	// 失敗したら webhookRetryBaseInterval * 2^(試行回数-1) 後に再送する
+	webhookRetryBaseInterval = 10 * time.Second
+	// この回数失敗したら諦める
+	webhookMaxAttempts = 8
+)
+
+// 受信側は X-Isupipe-Timestamp と本文を "." でつないだものの HMAC-SHA256 を検証する
+const (
+	webhookSignatureHeader = "X-Isupipe-Signature"
+	webhookTimestampHeader = "X-Isupipe-Timestamp"
+	webhookEventHeader     = "X-Isupipe-Event"
+	webhookDeliveryHeader  = "X-Isupipe-Delivery"
+)
+
+var webhookHTTPClient = &http.Client{
+	Timeout: webhookDeliveryTimeout,
+	Transport: &http.Transport{
+		// 環境変数のプロキシを経由すると接続先の検査をすり抜けるので使わない
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: webhookDeliveryTimeout,
+			// 登録後に名前解決の結果を変えて内部のアドレスに向ける (DNS rebinding) のを防ぐため、
+			// 実際に接続するアドレスをここでも検査する
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || !allowWebhookAddr(ip) {
+					return fmt.Errorf("webhook destination %s is not a public address", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: webhookDeliveryTimeout,
+	},
+}
+
+// allowWebhookAddr はWebhookを送ってよいアドレスかどうか。
+// テストではローカルの受信サーバに送れるよう差し替える
+var allowWebhookAddr = isPublicWebhookIP
+
+// isPublicWebhookIP はWebhookを送ってよいアドレスかどうか。
+// ループバック・プライベート・リンクローカル・未指定のアドレスには送らない
+func isPublicWebhookIP(ip net.IP) bool {
+	return !(ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified())
+}
+
+// verifyWebhookHost はホスト名を解決し、すべてのアドレスが送ってよいものか確かめる
+func verifyWebhookHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve webhook host: %w", err)
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("webhook host %s has no address", host)
+	}
+	for _, addr := range addrs {
+		if !allowWebhookAddr(addr.IP) {
+			return fmt.Errorf("webhook host %s resolves to a non-public address", host)
+		}
+	}
+	return nil
+}
+
+type WebhookDeliveryModel struct {
+	ID        int64  `db:"id"`
+	WebhookID int64  `db:"webhook_id"`
+	Event     string `db:"event"`
+	Payload   string `db:"payload"`
+	Status    string `db:"status"`
+	Attempts  int64  `db:"attempts"`
+	// 次に送信する時刻
+	NextAttemptAt int64 `db:"next_attempt_at"`
+	// 最後の試行の結果。応答がなければ0
+	LastStatusCode int64  `db:"last_status_code"`
+	LastError      string `db:"last_error"`
+	CreatedAt      int64  `db:"created_at"`
+	// 送信に成功していなければ0
+	DeliveredAt int64 `db:"delivered_at"`
+}
+
+type WebhookDelivery struct {
+	ID             int64  `json:"id"`
+	Event          string `json:"event"`
+	Payload        string `json:"payload"`
+	Status         string `json:"status"`
+	Attempts       int64  `json:"attempts"`
+	NextAttemptAt  int64  `json:"next_attempt_at"`
+	LastStatusCode int64  `json:"last_status_code"`
+	LastError      string `json:"last_error"`
+	CreatedAt      int64  `json:"created_at"`
+	DeliveredAt    int64  `json:"delivered_at"`
+}
+
+// runWebhookWorker は送信待ちのWebhookを定期的に取り出して送る
+func runWebhookWorker(ctx context.Context) {
+	ticker := time.NewTicker(webhookWorkerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := deliverPendingWebhooks(ctx); err != nil {
+				log.Printf("failed to deliver webhooks: %+v", err)
+			}
+		}
+	}
+}
+
+func deliverPendingWebhooks(ctx context.Context) error {
+	deliveryModels, err := claimPendingWebhookDeliveries(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, deliveryModel := range deliveryModels {
+		var webhookModel WebhookModel
+		if err := dbConn.GetContext(ctx, &webhookModel, "SELECT * FROM webhooks WHERE id = ?", deliveryModel.WebhookID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				// 取り出した後にWebhookが削除された
+				continue
+			}
+			return err
+		}
+
+		statusCode, deliverErr := sendWebhook(ctx, webhookModel, deliveryModel)
+		if err := recordWebhookAttempt(ctx, deliveryModel, statusCode, deliverErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimPendingWebhookDeliveries は送信時刻を迎えた送信を取り出し、
+// 応答を待つ間はほかのワーカーが重ねて送らないよう次の送信時刻を先送りしておく
+func claimPendingWebhookDeliveries(ctx context.Context) ([]WebhookDeliveryModel, error) {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	var deliveryModels []WebhookDeliveryModel
+	query := "SELECT * FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ? FOR UPDATE SKIP LOCKED"
+	if err := tx.SelectContext(ctx, &deliveryModels, query, webhookDeliveryPending, now, webhookWorkerBatchSize); err != nil {
+		return nil, err
+	}
+
+	lease := now + int64(webhookDeliveryTimeout/time.Second)*int64(len(deliveryModels)+1)
+	for _, deliveryModel := range deliveryModels {
+		// FIXME: N+1
+		if _, err := tx.ExecContext(ctx, "UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id = ?", lease, deliveryModel.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return deliveryModels, nil
+}
+
+// sendWebhook はペイロードに署名して送る。2xx以外の応答は失敗として扱う
+func sendWebhook(ctx context.Context, webhookModel WebhookModel, deliveryModel WebhookDeliveryModel) (int64, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	body := []byte(deliveryModel.Payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookModel.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookPayload(webhookModel.Secret, timestamp, body))
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookEventHeader, deliveryModel.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(deliveryModel.ID, 10))
+
+	res, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return int64(res.StatusCode), fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return int64(res.StatusCode), nil
+}
+
+func signWebhookPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// recordWebhookAttempt は試行の結果を送信履歴に残し、失敗していれば指数バックオフで再送を予約する
+func recordWebhookAttempt(ctx context.Context, deliveryModel WebhookDeliveryModel, statusCode int64, deliverErr error) error {
+	deliveryModel = applyWebhookAttempt(deliveryModel, statusCode, deliverErr, time.Now().Unix())
+
+	// 削除されたWebhookの送信は上書きしない
+	query := `
+	UPDATE webhook_deliveries
+	SET status = :status, attempts = :attempts, next_attempt_at = :next_attempt_at, last_status_code = :last_status_code, last_error = :last_error, delivered_at = :delivered_at
+	WHERE id = :id AND status = 'pending'`
+	_, err := dbConn.NamedExecContext(ctx, query, deliveryModel)
+	return err
+}
+
+// applyWebhookAttempt はnowに行った試行の結果を反映した送信を返す
+func applyWebhookAttempt(deliveryModel WebhookDeliveryModel, statusCode int64, deliverErr error, now int64) WebhookDeliveryModel {
+	deliveryModel.Attempts++
+	deliveryModel.LastStatusCode = statusCode
+
+	switch {
+	case deliverErr == nil:
+		deliveryModel.Status = webhookDeliverySucceeded
+		deliveryModel.LastError = ""
+		deliveryModel.DeliveredAt = now
+	case deliveryModel.Attempts >= webhookMaxAttempts:
+		deliveryModel.Status = webhookDeliveryFailed
+		deliveryModel.LastError = deliverErr.Error()
+	default:
+		deliveryModel.LastError = deliverErr.Error()
+		backoff := webhookRetryBaseInterval << (deliveryModel.Attempts - 1)
+		deliveryModel.NextAttemptAt = now + int64(backoff/time.Second)
+	}
+	return deliveryModel
+}
+
+func webhookDeliveryResponse(deliveryModel WebhookDeliveryModel) WebhookDelivery {
+	return WebhookDelivery{
+		ID:             deliveryModel.ID,
+		Event:          deliveryModel.Event,
+		Payload:        deliveryModel.Payload,
+		Status:         deliveryModel.Status,
+		Attempts:       deliveryModel.Attempts,
+		NextAttemptAt:  deliveryModel.NextAttemptAt,
+		LastStatusCode: deliveryModel.LastStatusCode,
+		LastError:      deliveryModel.LastError,
+		CreatedAt:      deliveryModel.CreatedAt,
+		DeliveredAt:    deliveryModel.DeliveredAt,
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// allowLocalWebhooks はテストの間だけhttptestの受信サーバに送れるようにする
+func allowLocalWebhooks(t *testing.T) {
+	t.Helper()
+
+	prev := allowWebhookAddr
+	allowWebhookAddr = func(net.IP) bool { return true }
+	t.Cleanup(func() {
+		allowWebhookAddr = prev
+	})
+}
+
+func TestSendWebhookSignsPayload(t *testing.T) {
+	allowLocalWebhooks(t)
+
+	const secret = "whsec_test"
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	got := make(chan received, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{header: r.Header.Clone(), body: body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+
+	webhookModel := WebhookModel{ID: 1, URL: server.URL, Secret: secret}
+	deliveryModel := WebhookDeliveryModel{ID: 42, WebhookID: 1, Event: webhookEventLivestreamReserved, Payload: `{"id":1}`}
+
+	statusCode, err := sendWebhook(context.Background(), webhookModel, deliveryModel)
+	if err != nil {
+		t.Fatalf("sendWebhook: %v", err)
+	}
+	if statusCode != http.StatusNoContent {
+		t.Errorf("status code = %d, want %d", statusCode, http.StatusNoContent)
+	}
+
+	r := <-got
+	if string(r.body) != deliveryModel.Payload {
+		t.Errorf("body = %s, want %s", r.body, deliveryModel.Payload)
+	}
+	timestamp := r.header.Get(webhookTimestampHeader)
+	if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+		t.Fatalf("%s = %q, want a unix time", webhookTimestampHeader, timestamp)
+	}
+	// 受信側と同じ手順で検証する
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + deliveryModel.Payload))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.header.Get(webhookSignatureHeader) != want {
+		t.Errorf("%s = %q, want %q", webhookSignatureHeader, r.header.Get(webhookSignatureHeader), want)
+	}
+	if r.header.Get(webhookEventHeader) != deliveryModel.Event {
+		t.Errorf("%s = %q, want %q", webhookEventHeader, r.header.Get(webhookEventHeader), deliveryModel.Event)
+	}
+	if r.header.Get(webhookDeliveryHeader) != "42" {
+		t.Errorf("%s = %q, want 42", webhookDeliveryHeader, r.header.Get(webhookDeliveryHeader))
+	}
+}
+
+func TestSendWebhookRejectsServerError(t *testing.T) {
+	allowLocalWebhooks(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	statusCode, err := sendWebhook(context.Background(), WebhookModel{URL: server.URL, Secret: "s"}, WebhookDeliveryModel{Payload: "{}"})
+	if err == nil {
+		t.Fatal("sendWebhook succeeded for a 503 response")
+	}
+	if statusCode != http.StatusServiceUnavailable {
+		t.Errorf("status code = %d, want %d", statusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestSendWebhookRefusesLoopbackByDefault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("webhook reached a loopback receiver")
+	}))
+	t.Cleanup(server.Close)
+
+	if _, err := sendWebhook(context.Background(), WebhookModel{URL: server.URL, Secret: "s"}, WebhookDeliveryModel{Payload: "{}"}); err == nil {
+		t.Fatal("sendWebhook succeeded for a loopback address")
+	}
+}
+
+func TestApplyWebhookAttempt(t *testing.T) {
+	const now = 1700000000
+	retryBase := int64(webhookRetryBaseInterval / time.Second)
+
+	tests := []struct {
+		name       string
+		attempts   int64
+		statusCode int64
+		err        error
+		want       WebhookDeliveryModel
+	}{
+		{
+			name:       "success",
+			statusCode: http.StatusOK,
+			want:       WebhookDeliveryModel{Status: webhookDeliverySucceeded, Attempts: 1, LastStatusCode: http.StatusOK, DeliveredAt: now},
+		},
+		{
+			name:       "first failure waits the base interval",
+			statusCode: http.StatusInternalServerError,
+			err:        errors.New("unexpected status code: 500"),
+			want:       WebhookDeliveryModel{Status: webhookDeliveryPending, Attempts: 1, NextAttemptAt: now + retryBase, LastStatusCode: http.StatusInternalServerError, LastError: "unexpected status code: 500"},
+		},
+		{
+			name:     "third failure backs off exponentially",
+			attempts: 2,
+			err:      errors.New("connection refused"),
+			want:     WebhookDeliveryModel{Status: webhookDeliveryPending, Attempts: 3, NextAttemptAt: now + 4*retryBase, LastError: "connection refused"},
+		},
+		{
+			name:       "last attempt gives up",
+			attempts:   webhookMaxAttempts - 1,
+			statusCode: http.StatusBadGateway,
+			err:        errors.New("unexpected status code: 502"),
+			want:       WebhookDeliveryModel{Status: webhookDeliveryFailed, Attempts: webhookMaxAttempts, LastStatusCode: http.StatusBadGateway, LastError: "unexpected status code: 502"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deliveryModel := WebhookDeliveryModel{Status: webhookDeliveryPending, Attempts: tt.attempts, LastError: "previous error"}
+			got := applyWebhookAttempt(deliveryModel, tt.statusCode, tt.err, now)
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendWebhookServerErrorSchedulesRetry(t *testing.T) {
+	allowLocalWebhooks(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(server.Close)
+
+	deliveryModel := WebhookDeliveryModel{ID: 1, Status: webhookDeliveryPending, Payload: "{}"}
+	statusCode, err := sendWebhook(context.Background(), WebhookModel{URL: server.URL, Secret: "s"}, deliveryModel)
+
+	now := time.Now().Unix()
+	got := applyWebhookAttempt(deliveryModel, statusCode, err, now)
+	if got.Status != webhookDeliveryPending || got.LastStatusCode != http.StatusInternalServerError {
+		t.Errorf("got %+v, want a pending delivery with status code 500", got)
+	}
+	if want := now + int64(webhookRetryBaseInterval/time.Second); got.NextAttemptAt != want {
+		t.Errorf("next_attempt_at = %d, want %d", got.NextAttemptAt, want)
+	}
+}
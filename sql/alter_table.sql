@@ -27,3 +27,135 @@ CREATE TABLE `icons` (
 PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 alter table icons add index user_id (user_id);
+-- アップロード時に揃えた画像の形式
+alter table icons add column content_type VARCHAR(255) NOT NULL DEFAULT 'image/jpeg';
+-- /api/icon/:hash で引く
+alter table icons add index hash (hash);
+
+-- 配信のキャンセル。キャンセルされていなければ0
+alter table livestreams add column cancelled_at BIGINT NOT NULL DEFAULT 0;
+
+-- 予約受付期間。この期間内に1時間ごとの予約枠が生成される
+CREATE TABLE `reservation_terms` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `start_at` BIGINT NOT NULL,
+  `end_at` BIGINT NOT NULL,
+  `slot_capacity` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+alter table reservation_terms add index start_at_and_end_at (start_at, end_at);
+
+-- メンテナンスなどで予約を受け付けない期間
+CREATE TABLE `reservation_blackouts` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `start_at` BIGINT NOT NULL,
+  `end_at` BIGINT NOT NULL,
+  `reason` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+alter table reservation_blackouts add index start_at_and_end_at (start_at, end_at);
+
+-- 繰り返し予約でまとめて作られた配信のシリーズ
+CREATE TABLE `livestream_series` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+-- 繰り返し予約でなければ0
+alter table livestreams add column series_id BIGINT NOT NULL DEFAULT 0;
+alter table livestreams add index series_id_and_start_at (series_id, start_at);
+
+-- 配信のコラボレーター (共同ホスト)
+CREATE TABLE `livestream_collaborators` (
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`livestream_id`, `user_id`),
+  INDEX `user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 廃止されたタグは一覧に出さず、新しく配信に付けられないようにする。廃止されていなければ0
+alter table tags add column deprecated_at BIGINT NOT NULL DEFAULT 0;
+
+-- フォロー関係
+CREATE TABLE `follows` (
+  `follower_id` BIGINT NOT NULL,
+  `followee_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`follower_id`, `followee_id`),
+  INDEX `followee_id` (`followee_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+alter table livestreams add index user_id_and_start_at (user_id, start_at);
+
+-- 通知
+alter table follows add column notify TINYINT(1) NOT NULL DEFAULT 0;
+alter table livestreams add column live_notified_at BIGINT NOT NULL DEFAULT 0;
+alter table livestreams add index live_notified_at_and_start_at (live_notified_at, start_at);
+CREATE TABLE `notifications` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `type` VARCHAR(255) NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `read_at` BIGINT NOT NULL DEFAULT 0,
+  INDEX `user_id_and_id` (`user_id`, `id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE TABLE `notification_settings` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `muted_until` BIGINT NOT NULL DEFAULT 0,
+  `mute_reservations` TINYINT(1) NOT NULL DEFAULT 0,
+  `mute_live` TINYINT(1) NOT NULL DEFAULT 0
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- Webhook
+CREATE TABLE `webhooks` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `url` VARCHAR(2048) NOT NULL,
+  `secret` VARCHAR(255) NOT NULL,
+  `events` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE TABLE `webhook_deliveries` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `webhook_id` BIGINT NOT NULL,
+  `event` VARCHAR(255) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `status` VARCHAR(255) NOT NULL,
+  `attempts` BIGINT NOT NULL DEFAULT 0,
+  `next_attempt_at` BIGINT NOT NULL,
+  `last_status_code` BIGINT NOT NULL DEFAULT 0,
+  `last_error` TEXT NOT NULL DEFAULT (''),
+  `created_at` BIGINT NOT NULL,
+  `delivered_at` BIGINT NOT NULL DEFAULT 0,
+  INDEX `status_and_next_attempt_at` (`status`, `next_attempt_at`),
+  INDEX `webhook_id_and_id` (`webhook_id`, `id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- APIトークン
+CREATE TABLE `api_tokens` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `token_hash` CHAR(64) NOT NULL,
+  `scopes` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `expires_at` BIGINT NOT NULL DEFAULT 0,
+  `last_used_at` BIGINT NOT NULL DEFAULT 0,
+  `revoked_at` BIGINT NOT NULL DEFAULT 0,
+  UNIQUE `token_hash` (`token_hash`),
+  INDEX `user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 退会
+alter table users add column deleted_at BIGINT NOT NULL DEFAULT 0;
+alter table users add column purged_at BIGINT NOT NULL DEFAULT 0;
+alter table users add index deleted_at_and_purged_at (deleted_at, purged_at);
+
+-- アイコンの履歴
+alter table icons add column created_at BIGINT NOT NULL DEFAULT 0;
+-- 同じユーザが同じ画像を重ねて登録しない
+alter table icons add unique user_id_and_hash (user_id, hash);
+-- 選んでいるアイコン。0なら一番新しいアイコン
+alter table users add column icon_id BIGINT NOT NULL DEFAULT 0;
@@ -1,6 +1,8 @@
 TRUNCATE TABLE themes;
 TRUNCATE TABLE icons;
 TRUNCATE TABLE reservation_slots;
+TRUNCATE TABLE reservation_terms;
+TRUNCATE TABLE reservation_blackouts;
 TRUNCATE TABLE livestream_viewers_history;
 TRUNCATE TABLE livecomment_reports;
 TRUNCATE TABLE ng_words;
@@ -9,11 +11,21 @@ TRUNCATE TABLE tags;
 TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
 TRUNCATE TABLE livestreams;
+TRUNCATE TABLE livestream_series;
+TRUNCATE TABLE livestream_collaborators;
+TRUNCATE TABLE follows;
+TRUNCATE TABLE notifications;
+TRUNCATE TABLE notification_settings;
+TRUNCATE TABLE webhooks;
+TRUNCATE TABLE webhook_deliveries;
+TRUNCATE TABLE api_tokens;
 TRUNCATE TABLE users;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
 ALTER TABLE `reservation_slots` auto_increment = 1;
+ALTER TABLE `reservation_terms` auto_increment = 1;
+ALTER TABLE `reservation_blackouts` auto_increment = 1;
 ALTER TABLE `livestream_tags` auto_increment = 1;
 ALTER TABLE `livestream_viewers_history` auto_increment = 1;
 ALTER TABLE `livecomment_reports` auto_increment = 1;
@@ -22,4 +34,9 @@ ALTER TABLE `reactions` auto_increment = 1;
 ALTER TABLE `tags` auto_increment = 1;
 ALTER TABLE `livecomments` auto_increment = 1;
 ALTER TABLE `livestreams` auto_increment = 1;
+ALTER TABLE `livestream_series` auto_increment = 1;
+ALTER TABLE `notifications` auto_increment = 1;
+ALTER TABLE `webhooks` auto_increment = 1;
+ALTER TABLE `webhook_deliveries` auto_increment = 1;
+ALTER TABLE `api_tokens` auto_increment = 1;
 ALTER TABLE `users` auto_increment = 1;
@@ -0,0 +1,4 @@
+-- 2023/11/25 10:00からの１年間
+INSERT INTO reservation_terms (start_at, end_at, slot_capacity, created_at)
+VALUES
+	(1700874000, 1732496400, 5, 1700874000);